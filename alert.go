@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Readings above TEMP_MAX or HUMIDITY_MAX are reported to ALERT_WEBHOOK_URL.
+// Alerting is off when no webhook is configured, and each threshold is
+// skipped when unset. The thresholds live in runtimeConfig so they can be
+// tuned without a restart.
+var (
+	alertWebhookURL     string
+	alertWebhookTimeout = 5 * time.Second
+)
+
+type SensorAlert struct {
+	Threshold string      `json:"threshold"`
+	Limit     float64     `json:"limit"`
+	Value     float64     `json:"value"`
+	Reading   *SensorData `json:"reading"`
+}
+
+func configureAlerts() {
+	alertWebhookURL = getEnvString("ALERT_WEBHOOK_URL", "")
+	alertWebhookTimeout = getEnvDuration("ALERT_WEBHOOK_TIMEOUT", alertWebhookTimeout)
+	cfg := liveConfig()
+	if alertWebhookURL == "" && (!math.IsInf(cfg.alertTempMax, 1) || !math.IsInf(cfg.alertHumidityMax, 1)) {
+		logger.Warn("alert thresholds are set but $ALERT_WEBHOOK_URL is not; no alerts will be sent")
+	}
+}
+
+// checkThresholds returns an alert for every threshold the reading exceeds.
+func checkThresholds(data *SensorData) []SensorAlert {
+	cfg := liveConfig()
+	var alerts []SensorAlert
+	if data.Temperature > cfg.alertTempMax {
+		alerts = append(alerts, SensorAlert{Threshold: "temperature_max", Limit: cfg.alertTempMax, Value: data.Temperature, Reading: data})
+	}
+	if data.Humidity > cfg.alertHumidityMax {
+		alerts = append(alerts, SensorAlert{Threshold: "humidity_max", Limit: cfg.alertHumidityMax, Value: data.Humidity, Reading: data})
+	}
+	return alerts
+}
+
+// raiseAlerts posts an alert for each tripped threshold in the background so
+// a slow or failing webhook never holds up ingestion.
+func raiseAlerts(data *SensorData) {
+	if alertWebhookURL == "" {
+		return
+	}
+	for _, alert := range checkThresholds(data) {
+		go func(alert SensorAlert) {
+			if err := postAlert(alert); err != nil {
+				logger.Error("error sending alert webhook", zap.String("threshold", alert.Threshold), zap.String("device_id", alert.Reading.DeviceID), zap.Error(err))
+			}
+		}(alert)
+	}
+}
+
+// postAlert delivers alert to the webhook, retrying once if the first
+// attempt fails or isn't answered with a 2xx.
+func postAlert(alert SensorAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = postAlertOnce(body)
+		if err == nil || attempt == 2 {
+			return err
+		}
+		logger.Warn("alert webhook failed, retrying", zap.String("threshold", alert.Threshold), zap.Error(err))
+	}
+}
+
+func postAlertOnce(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, alertWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// parseAPIKeys splits API_KEY into its comma-separated keys so several
+// clients (or an old and a new key during rotation) can be valid at once.
+func parseAPIKeys(raw string) [][]byte {
+	var keys [][]byte
+	for _, key := range strings.Split(raw, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+// requireAPIKey guards write routes with the X-API-Key header. It fails
+// closed: when API_KEY is unset every request is rejected. Every configured
+// key is compared in constant time, without stopping at the first match, so
+// response timing doesn't reveal how much of a key was right.
+func requireAPIKey() gin.HandlerFunc {
+	keys := parseAPIKeys(os.Getenv("API_KEY"))
+	if len(keys) == 0 {
+		logger.Warn("$API_KEY is not set; all requests to protected routes will be rejected")
+	}
+	return func(c *gin.Context) {
+		provided := []byte(c.GetHeader("X-API-Key"))
+		match := 0
+		for _, key := range keys {
+			match |= subtle.ConstantTimeCompare(provided, key)
+		}
+		if len(provided) == 0 || match != 1 {
+			loggerFor(c).Error("unauthorized request", zap.String("path", c.Request.URL.Path), zap.String("client_ip", c.ClientIP()))
+			abortWithJSON(c, http.StatusUnauthorized, gin.H{"error": "invalid or missing api key"})
+			return
+		}
+		c.Next()
+	}
+}
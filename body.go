@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limitRequestBody caps every request body at MAX_BODY_BYTES (default 1MB)
+// so a client can't make a handler buffer an arbitrarily large payload.
+// Requests that declare a larger Content-Length are refused up front; bodies
+// that turn out larger while being read fail in the decoder, see
+// respondBindError.
+func limitRequestBody() gin.HandlerFunc {
+	maxBytes := int64(getEnvInt("MAX_BODY_BYTES", 1<<20))
+	if maxBytes <= 0 {
+		logger.Fatal("$MAX_BODY_BYTES must be positive")
+	}
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			abortWithJSON(c, http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds limit of %d bytes", maxBytes)})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// respondBindError reports a failure to decode the request body: 413 when
+// the body was cut off by limitRequestBody, 400 for anything else.
+func respondBindError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondJSON(c, http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds limit of %d bytes", tooLarge.Limit)})
+		return
+	}
+	respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// requireJSON rejects requests whose Content-Type isn't application/json
+// with 415, rather than letting the binder guess at the body's format.
+func requireJSON(c *gin.Context) {
+	if c.ContentType() != gin.MIMEJSON {
+		abortWithJSON(c, http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/json"})
+		return
+	}
+	c.Next()
+}
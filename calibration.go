@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// calibrations corrects readings per device before they are stored
+// (CALIBRATION_ENABLED). It is nil, and applying it a no-op, when disabled.
+var calibrations *calibrationSource
+
+// Calibration corrects a device's raw values as value*scale + offset. A zero
+// scale is treated as 1 so a calibration can set just an offset.
+type Calibration struct {
+	TemperatureOffset float64 `json:"temperature_offset" bson:"temperature_offset"`
+	TemperatureScale  float64 `json:"temperature_scale" bson:"temperature_scale" binding:"gte=0"`
+	HumidityOffset    float64 `json:"humidity_offset" bson:"humidity_offset"`
+	HumidityScale     float64 `json:"humidity_scale" bson:"humidity_scale" binding:"gte=0"`
+}
+
+// RawReading keeps the values a device sent before calibration.
+type RawReading struct {
+	Temperature float64 `json:"temperature" bson:"temperature"`
+	Humidity    float64 `json:"humidity" bson:"humidity"`
+}
+
+func calibrate(value, scale, offset float64) float64 {
+	if scale == 0 {
+		scale = 1
+	}
+	return value*scale + offset
+}
+
+// calibrationSource looks up a device's calibration, first in the static
+// DEVICE_CALIBRATIONS config and then in the calibration field of its
+// devices document. Lookups are cached for ttl so ingest doesn't read the
+// devices collection for every reading; a device without a calibration is
+// cached too.
+type calibrationSource struct {
+	mc      *mongo.Collection
+	static  map[string]Calibration
+	ttl     time.Duration
+	keepRaw bool
+	mu      sync.Mutex
+	cached  map[string]cachedCalibration
+}
+
+type cachedCalibration struct {
+	calibration *Calibration
+	expires     time.Time
+}
+
+// parseCalibrations reads DEVICE_CALIBRATIONS, a JSON object mapping device
+// ids to calibrations.
+func parseCalibrations(raw string) (map[string]Calibration, error) {
+	static := map[string]Calibration{}
+	if raw == "" {
+		return static, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &static); err != nil {
+		return nil, err
+	}
+	for deviceId, c := range static {
+		if !deviceIdPattern.MatchString(deviceId) {
+			return nil, fmt.Errorf("invalid device id %q", deviceId)
+		}
+		if c.TemperatureScale < 0 || c.HumidityScale < 0 {
+			return nil, fmt.Errorf("negative scale for device %q", deviceId)
+		}
+	}
+	return static, nil
+}
+
+func newCalibrationSource(mc *mongo.Collection, static map[string]Calibration, ttl time.Duration, keepRaw bool) *calibrationSource {
+	return &calibrationSource{
+		mc:      mc,
+		static:  static,
+		ttl:     ttl,
+		keepRaw: keepRaw,
+		cached:  make(map[string]cachedCalibration),
+	}
+}
+
+func (s *calibrationSource) lookup(ctx context.Context, deviceId string) (*Calibration, error) {
+	if c, ok := s.static[deviceId]; ok {
+		return &c, nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	entry, ok := s.cached[deviceId]
+	s.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.calibration, nil
+	}
+
+	var device struct {
+		Calibration *Calibration `bson:"calibration"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"calibration": 1})
+	err := s.mc.FindOne(ctx, bson.M{"_id": deviceId}, opts).Decode(&device)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cached[deviceId] = cachedCalibration{calibration: device.Calibration, expires: now.Add(s.ttl)}
+	s.mu.Unlock()
+	return device.Calibration, nil
+}
+
+// forget drops a device's cached calibration after it was changed through
+// the API, so the change applies to the next reading on this instance.
+func (s *calibrationSource) forget(deviceId string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.cached, deviceId)
+	s.mu.Unlock()
+}
+
+// apply calibrates data in place, keeping the raw values in data.Raw when
+// CALIBRATION_KEEP_RAW is set. Readings from devices without a calibration
+// are left untouched.
+func (s *calibrationSource) apply(ctx context.Context, data *SensorData) error {
+	if s == nil {
+		return nil
+	}
+	c, err := s.lookup(ctx, data.DeviceID)
+	if err != nil {
+		return fmt.Errorf("looking up calibration for device %s: %w", data.DeviceID, err)
+	}
+	if c == nil {
+		return nil
+	}
+	if s.keepRaw {
+		data.Raw = &RawReading{Temperature: data.Temperature, Humidity: data.Humidity}
+	}
+	data.Temperature = calibrate(data.Temperature, c.TemperatureScale, c.TemperatureOffset)
+	data.Humidity = calibrate(data.Humidity, c.HumidityScale, c.HumidityOffset)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCalibrationSourceApply(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("from devices collection, cached", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.devices", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: "dev-1"},
+			{Key: "calibration", Value: bson.D{
+				{Key: "temperature_offset", Value: -0.5},
+				{Key: "humidity_scale", Value: 2.0},
+			}},
+		}))
+		source := newCalibrationSource(mt.Coll, nil, time.Minute, true)
+
+		for i := 0; i < 2; i++ {
+			// the second reading must come from the cache; the mock has no
+			// response left for another lookup
+			data := &SensorData{DeviceID: "dev-1", Temperature: 20, Humidity: 30}
+			if err := source.apply(context.Background(), data); err != nil {
+				mt.Fatalf("apply #%d: %v", i+1, err)
+			}
+			if data.Temperature != 19.5 || data.Humidity != 60 {
+				mt.Fatalf("apply #%d calibrated to %v/%v, want 19.5/60", i+1, data.Temperature, data.Humidity)
+			}
+			if data.Raw == nil || data.Raw.Temperature != 20 || data.Raw.Humidity != 30 {
+				mt.Fatalf("apply #%d kept raw %+v, want 20/30", i+1, data.Raw)
+			}
+		}
+	})
+	mt.Run("static config wins, raw not kept", func(mt *mtest.T) {
+		static, err := parseCalibrations(`{"dev-1":{"temperature_scale":0.5,"temperature_offset":-20}}`)
+		if err != nil {
+			mt.Fatalf("parseCalibrations: %v", err)
+		}
+		source := newCalibrationSource(mt.Coll, static, time.Minute, false)
+
+		data := &SensorData{DeviceID: "dev-1", Temperature: 140, Humidity: 30}
+		if err := source.apply(context.Background(), data); err != nil {
+			mt.Fatalf("apply: %v", err)
+		}
+		if data.Temperature != 50 || data.Humidity != 30 || data.Raw != nil {
+			mt.Fatalf("apply gave %+v, want 50/30 without raw", data)
+		}
+	})
+	mt.Run("uncalibrated device untouched", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.devices", mtest.FirstBatch))
+		source := newCalibrationSource(mt.Coll, nil, time.Minute, true)
+
+		data := &SensorData{DeviceID: "dev-2", Temperature: 20, Humidity: 30}
+		if err := source.apply(context.Background(), data); err != nil {
+			mt.Fatalf("apply: %v", err)
+		}
+		if data.Temperature != 20 || data.Humidity != 30 || data.Raw != nil {
+			mt.Fatalf("apply changed an uncalibrated reading: %+v", data)
+		}
+	})
+}
+
+func TestParseCalibrationsRejectsNegativeScale(t *testing.T) {
+	if _, err := parseCalibrations(`{"dev-1":{"humidity_scale":-1}}`); err == nil {
+		t.Fatal("negative scale was accepted")
+	}
+}
+
+// The range is checked on calibrated values: a reading out of range as sent
+// can be stored once calibrated, and one calibrated out of range can't.
+func TestPrepareSensorDataChecksCalibratedRange(t *testing.T) {
+	static, err := parseCalibrations(`{"fahrenheit":{"temperature_scale":0.5,"temperature_offset":-20},"broken":{"humidity_offset":80}}`)
+	if err != nil {
+		t.Fatalf("parseCalibrations: %v", err)
+	}
+	calibrations = newCalibrationSource(nil, static, time.Minute, false)
+	t.Cleanup(func() { calibrations = nil })
+
+	data := &SensorData{DeviceID: "fahrenheit", Temperature: 140, Humidity: 30}
+	if err := prepareSensorData(context.Background(), data); err != nil {
+		t.Fatalf("reading in range once calibrated was rejected: %v", err)
+	}
+	data = &SensorData{DeviceID: "broken", Temperature: 20, Humidity: 30}
+	if err := prepareSensorData(context.Background(), data); !errors.As(err, new(rangeError)) {
+		t.Fatalf("reading calibrated out of range: got %v, want a rangeError", err)
+	}
+}
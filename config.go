@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// runtimeConfig holds the settings that can be changed while the server
+// runs, through PUT /admin/config: the alert thresholds, the CORS allow-list
+// and the request log sample rate. A stored runtimeConfig is never
+// modified; an update builds a new one and swaps it in, so readers see
+// either all of an update or none of it.
+type runtimeConfig struct {
+	// alertTempMax and alertHumidityMax start from TEMP_MAX and
+	// HUMIDITY_MAX; +Inf turns a threshold off.
+	alertTempMax     float64
+	alertHumidityMax float64
+	cors             corsConfig
+	// logSampleRate is the fraction of successful requests requestLogger
+	// logs (LOG_SAMPLE_RATE, default 1); failed ones are always logged.
+	logSampleRate float64
+}
+
+var defaultRuntimeConfig = runtimeConfig{
+	alertTempMax:     math.Inf(1),
+	alertHumidityMax: math.Inf(1),
+	logSampleRate:    1,
+}
+
+// currentConfig is read on every request; configMu only serialises
+// updates, so two admins changing different fields don't undo each other.
+var (
+	currentConfig atomic.Pointer[runtimeConfig]
+	configMu      sync.Mutex
+)
+
+// liveConfig returns the settings in effect.
+func liveConfig() *runtimeConfig {
+	if cfg := currentConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &defaultRuntimeConfig
+}
+
+func configureRuntime() {
+	cfg := &runtimeConfig{
+		alertTempMax:     getEnvFloat("TEMP_MAX", defaultRuntimeConfig.alertTempMax),
+		alertHumidityMax: getEnvFloat("HUMIDITY_MAX", defaultRuntimeConfig.alertHumidityMax),
+		cors:             loadCORSConfig(),
+		logSampleRate:    getEnvFloat("LOG_SAMPLE_RATE", defaultRuntimeConfig.logSampleRate),
+	}
+	if cfg.logSampleRate < 0 || cfg.logSampleRate > 1 {
+		logger.Fatal("$LOG_SAMPLE_RATE must be between 0 and 1")
+	}
+	currentConfig.Store(cfg)
+}
+
+// updateRuntimeConfig applies update, a JSON object holding any of the
+// fields of runtimeConfigView, on top of the settings in effect and swaps
+// the result in. Nothing changes if any field is invalid.
+func updateRuntimeConfig(update map[string]json.RawMessage) (*runtimeConfig, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	cfg, err := liveConfig().withUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	currentConfig.Store(cfg)
+	return cfg, nil
+}
+
+// withUpdate returns a copy of cfg with update applied. A threshold set to
+// null is turned off.
+func (cfg runtimeConfig) withUpdate(update map[string]json.RawMessage) (*runtimeConfig, error) {
+	keys := make([]string, 0, len(update))
+	for key := range update {
+		keys = append(keys, key)
+	}
+	// sorted so the same bad update always reports the same field
+	sort.Strings(keys)
+	for _, key := range keys {
+		raw := update[key]
+		var err error
+		switch key {
+		case "temp_max":
+			cfg.alertTempMax, err = decodeThreshold(raw)
+		case "humidity_max":
+			cfg.alertHumidityMax, err = decodeThreshold(raw)
+		case "cors_origins":
+			var origins []string
+			if err = json.Unmarshal(raw, &origins); err == nil {
+				for _, origin := range origins {
+					if err = validateOrigin(origin); err != nil {
+						break
+					}
+				}
+			}
+			cfg.cors = newCORSConfig(origins, cfg.cors.maxAge)
+		case "log_sample_rate":
+			err = json.Unmarshal(raw, &cfg.logSampleRate)
+			if err == nil && (cfg.logSampleRate < 0 || cfg.logSampleRate > 1) {
+				err = fmt.Errorf("%v is not between 0 and 1", cfg.logSampleRate)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func decodeThreshold(raw json.RawMessage) (float64, error) {
+	var limit *float64
+	if err := json.Unmarshal(raw, &limit); err != nil {
+		return 0, err
+	}
+	if limit == nil {
+		return math.Inf(1), nil
+	}
+	return *limit, nil
+}
+
+// validateOrigin accepts "*" or a bare http(s) origin such as
+// https://example.com:8080.
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Scheme+"://"+u.Host != origin {
+		return fmt.Errorf("%q is not an origin like https://example.com", origin)
+	}
+	return nil
+}
+
+// runtimeConfigView is how GET and PUT /admin/config show the settings;
+// a threshold that is off is null.
+type runtimeConfigView struct {
+	TempMax       *float64 `json:"temp_max"`
+	HumidityMax   *float64 `json:"humidity_max"`
+	CORSOrigins   []string `json:"cors_origins"`
+	LogSampleRate float64  `json:"log_sample_rate"`
+}
+
+func (cfg *runtimeConfig) view() runtimeConfigView {
+	threshold := func(limit float64) *float64 {
+		if math.IsInf(limit, 1) {
+			return nil
+		}
+		return &limit
+	}
+	return runtimeConfigView{
+		TempMax:       threshold(cfg.alertTempMax),
+		HumidityMax:   threshold(cfg.alertHumidityMax),
+		CORSOrigins:   cfg.cors.list(),
+		LogSampleRate: cfg.logSampleRate,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func resetRuntimeConfig(t *testing.T) {
+	t.Helper()
+	currentConfig.Store(&defaultRuntimeConfig)
+	t.Cleanup(func() { currentConfig.Store(nil) })
+}
+
+func TestUpdateRuntimeConfigRejectsInvalidUpdates(t *testing.T) {
+	cases := []struct {
+		name   string
+		update string
+	}{
+		{"unknown field", `{"temp_min":1}`},
+		{"threshold not a number", `{"temp_max":"hot"}`},
+		{"sample rate above 1", `{"log_sample_rate":1.5}`},
+		{"origin with a path", `{"cors_origins":["https://example.com/app"]}`},
+		{"origin without scheme", `{"cors_origins":["example.com"]}`},
+		// one bad field must not let the good one through
+		{"partly valid", `{"temp_max":30,"log_sample_rate":-1}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetRuntimeConfig(t)
+			var update map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tc.update), &update); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := updateRuntimeConfig(update); err == nil {
+				t.Fatalf("update %s was accepted", tc.update)
+			}
+			if cfg := liveConfig(); !math.IsInf(cfg.alertTempMax, 1) || cfg.logSampleRate != 1 {
+				t.Fatalf("rejected update changed the config: %+v", cfg.view())
+			}
+		})
+	}
+}
+
+// A changed allow-list applies to the next request without rebuilding the
+// middleware.
+func TestCORSAllowListUpdatesAtRuntime(t *testing.T) {
+	resetRuntimeConfig(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(corsMiddleware())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	allowOrigin := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", "https://dash.example.com")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	if got := allowOrigin(); got != "" {
+		t.Fatalf("origin allowed before being listed: %q", got)
+	}
+	cfg, err := updateRuntimeConfig(map[string]json.RawMessage{
+		"cors_origins": json.RawMessage(`["https://dash.example.com"]`),
+		"temp_max":     json.RawMessage(`35.5`),
+	})
+	if err != nil {
+		t.Fatalf("valid update rejected: %v", err)
+	}
+	if got := allowOrigin(); got != "https://dash.example.com" {
+		t.Fatalf("Access-Control-Allow-Origin = %q after update", got)
+	}
+	if view := cfg.view(); view.TempMax == nil || *view.TempMax != 35.5 || view.HumidityMax != nil {
+		t.Fatalf("config after update = %+v", view)
+	}
+}
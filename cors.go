@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// corsConfig is the set of browser origins allowed to call the API and open
+// websockets, from CORS_ORIGINS (comma-separated, "*" for any origin). It is
+// part of runtimeConfig, so the allow-list can be changed at runtime.
+type corsConfig struct {
+	configured bool
+	allowAll   bool
+	origins    map[string]bool
+	maxAge     int
+}
+
+func loadCORSConfig() corsConfig {
+	return newCORSConfig(strings.Split(os.Getenv("CORS_ORIGINS"), ","), getEnvInt("CORS_MAX_AGE", 600))
+}
+
+func newCORSConfig(origins []string, maxAge int) corsConfig {
+	cfg := corsConfig{origins: make(map[string]bool), maxAge: maxAge}
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+			continue
+		case "*":
+			cfg.allowAll = true
+		default:
+			cfg.origins[origin] = true
+		}
+		cfg.configured = true
+	}
+	return cfg
+}
+
+func (cfg corsConfig) allowed(origin string) bool {
+	return cfg.allowAll || cfg.origins[origin]
+}
+
+// list returns the allow-list as configured, sorted.
+func (cfg corsConfig) list() []string {
+	origins := make([]string, 0, len(cfg.origins)+1)
+	if cfg.allowAll {
+		origins = append(origins, "*")
+	}
+	for origin := range cfg.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// checkOrigin is the websocket upgrader's origin check. With CORS_ORIGINS
+// unset or "*" it stays permissive for local development; otherwise a
+// browser origin must be on the allow-list, and the upgrade is refused with
+// 403. Requests without an Origin header don't come from a browser and are
+// let through.
+func (cfg corsConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !cfg.configured || origin == "" || cfg.allowed(origin) {
+		return true
+	}
+	logger.Warn("websocket origin rejected", zap.String("origin", origin), zap.String("remote_addr", r.RemoteAddr))
+	return false
+}
+
+// corsMiddleware adds CORS headers for allowed origins to every response,
+// errors included so browsers can read the error body, and answers
+// preflight OPTIONS requests with 204. The allow-list in effect is read on
+// each request.
+func corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := liveConfig().cors
+		origin := c.GetHeader("Origin")
+		if origin == "" || !cfg.allowed(origin) {
+			c.Next()
+			return
+		}
+		if cfg.allowAll {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+		}
+		c.Header("Access-Control-Expose-Headers", "Location, Retry-After, X-Request-ID")
+
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Request-ID")
+			c.Header("Access-Control-Max-Age", strconv.Itoa(cfg.maxAge))
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// deadLetters keeps readings that failed to store for later auditing
+// (DEAD_LETTER_ENABLED). It is nil, and recording a no-op, when disabled.
+var deadLetters *deadLetterSink
+
+// FailedReading is a reading that could not be stored, with the reason.
+type FailedReading struct {
+	Reading  *SensorData `json:"reading" bson:"reading"`
+	Error    string      `json:"error" bson:"error"`
+	FailedAt time.Time   `json:"failed_at" bson:"failed_at"`
+}
+
+// deadLetterSink writes failed readings to their own collection and, when
+// that insert fails too (most likely because MongoDB itself is the
+// problem), appends them as NDJSON to a local file instead.
+type deadLetterSink struct {
+	mc      *mongo.Collection
+	path    string
+	timeout time.Duration
+	mu      sync.Mutex
+}
+
+func newDeadLetterSink(mc *mongo.Collection, path string, timeout time.Duration) *deadLetterSink {
+	return &deadLetterSink{mc: mc, path: path, timeout: timeout}
+}
+
+// record stores the failed readings in the background; it never blocks or
+// fails the request that produced them.
+func (s *deadLetterSink) record(cause error, data ...*SensorData) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	failed := make([]interface{}, len(data))
+	for i, d := range data {
+		failed[i] = FailedReading{Reading: d, Error: cause.Error(), FailedAt: now}
+	}
+	go func() {
+		// the request context is likely done or expired by now
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+		_, err := s.mc.InsertMany(ctx, failed)
+		if err == nil {
+			return
+		}
+		logger.Warn("error storing failed readings, falling back to file", zap.String("path", s.path), zap.Error(err))
+		if err := s.appendToFile(failed); err != nil {
+			logger.Error("error writing failed readings to file", zap.String("path", s.path), zap.Int("count", len(failed)), zap.Error(err))
+		}
+	}()
+}
+
+func (s *deadLetterSink) appendToFile(failed []interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range failed {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// DeadLetterReplay counts the outcome of replaying the dead-letter file.
+// Replayed readings either succeeded or failed; Remaining is how many are
+// left in the file, including any not reached before the request ended.
+type DeadLetterReplay struct {
+	Replayed  int `json:"replayed"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Remaining int `json:"remaining"`
+}
+
+// replayFile re-inserts the readings in the dead-letter file through store,
+// rewriting the file to hold only those still unstored. Readings are given
+// an id, saved back to the file, before any is inserted, so a replay cut
+// short by a crash can simply be run again: readings it already stored come
+// back as duplicate keys and count as succeeded. Like backfilled readings,
+// replayed ones are old news and are stored without being broadcast.
+// Appends to the file wait while a replay runs.
+func (s *deadLetterSink) replayFile(ctx context.Context, store SensorStore) (DeadLetterReplay, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result DeadLetterReplay
+	failed, err := s.readFile()
+	if err != nil || len(failed) == 0 {
+		return result, err
+	}
+	assigned := false
+	for _, f := range failed {
+		if f.Reading.Id.IsZero() {
+			f.Reading.Id = primitive.NewObjectID()
+			assigned = true
+		}
+	}
+	if assigned {
+		if err := s.rewriteFile(failed); err != nil {
+			return result, err
+		}
+	}
+
+	var kept []*FailedReading
+	for i, f := range failed {
+		if ctx.Err() != nil {
+			kept = append(kept, failed[i:]...)
+			break
+		}
+		result.Replayed++
+		start := time.Now()
+		_, err := store.Add(ctx, f.Reading)
+		sensorInsertDuration.Observe(time.Since(start).Seconds())
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			sensorInsertFailures.Inc()
+			result.Failed++
+			f.Error = err.Error()
+			f.FailedAt = time.Now().UTC()
+			kept = append(kept, f)
+			continue
+		}
+		result.Succeeded++
+		if err == nil {
+			sensorInserts.Inc()
+		}
+	}
+	result.Remaining = len(kept)
+	return result, s.rewriteFile(kept)
+}
+
+// readFile loads the dead-letter file; a missing file holds no readings.
+func (s *deadLetterSink) readFile() ([]*FailedReading, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var failed []*FailedReading
+	dec := json.NewDecoder(f)
+	for {
+		var r FailedReading
+		if err := dec.Decode(&r); err == io.EOF {
+			return failed, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", s.path, err)
+		}
+		if r.Reading != nil {
+			failed = append(failed, &r)
+		}
+	}
+}
+
+// rewriteFile replaces the dead-letter file with failed through a temporary
+// file and a rename, so an interrupted rewrite leaves the old file intact.
+// An empty failed removes the file.
+func (s *deadLetterSink) rewriteFile(failed []*FailedReading) error {
+	if len(failed) == 0 {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range failed {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
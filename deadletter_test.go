@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// replayStore fails Add for the devices in fail and reports readings it
+// already holds as duplicate keys, as MongoDB would.
+type replayStore struct {
+	SensorStore
+	fail   map[string]bool
+	stored map[primitive.ObjectID]*SensorData
+}
+
+func (s *replayStore) Add(ctx context.Context, data *SensorData) (primitive.ObjectID, error) {
+	if s.fail[data.DeviceID] {
+		return primitive.NilObjectID, errors.New("insert failed")
+	}
+	if _, ok := s.stored[data.Id]; ok {
+		return primitive.NilObjectID, mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}
+	}
+	s.stored[data.Id] = data
+	return data.Id, nil
+}
+
+func TestDeadLetterReplayKeepsFailuresAndIsRepeatable(t *testing.T) {
+	sink := newDeadLetterSink(nil, filepath.Join(t.TempDir(), "failed.ndjson"), 0)
+	if err := sink.appendToFile([]interface{}{
+		FailedReading{Reading: &SensorData{DeviceID: "dev-1"}, Error: "boom"},
+		FailedReading{Reading: &SensorData{DeviceID: "dev-2"}, Error: "boom"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store := &replayStore{fail: map[string]bool{"dev-2": true}, stored: map[primitive.ObjectID]*SensorData{}}
+
+	result, err := sink.replayFile(context.Background(), store)
+	if err != nil {
+		t.Fatalf("replayFile returned error: %v", err)
+	}
+	if want := (DeadLetterReplay{Replayed: 2, Succeeded: 1, Failed: 1, Remaining: 1}); result != want {
+		t.Fatalf("first replay = %+v, want %+v", result, want)
+	}
+	left, err := sink.readFile()
+	if err != nil || len(left) != 1 || left[0].Reading.DeviceID != "dev-2" {
+		t.Fatalf("file after first replay = %+v, %v; want only dev-2", left, err)
+	}
+
+	// as if a run stored dev-2 and was killed before rewriting the file
+	store.stored[left[0].Reading.Id] = left[0].Reading
+	store.fail = nil
+	result, err = sink.replayFile(context.Background(), store)
+	if err != nil {
+		t.Fatalf("replayFile returned error: %v", err)
+	}
+	if want := (DeadLetterReplay{Replayed: 1, Succeeded: 1}); result != want {
+		t.Fatalf("second replay = %+v, want %+v", result, want)
+	}
+	if len(store.stored) != 2 {
+		t.Fatalf("store holds %d readings, want 2", len(store.stored))
+	}
+	if left, err := sink.readFile(); err != nil || len(left) != 0 {
+		t.Fatalf("file after second replay = %+v, %v; want it gone", left, err)
+	}
+}
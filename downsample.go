@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+)
+
+// maxDownsampleBuckets bounds how many buckets one /sensor/downsample
+// response may hold (DOWNSAMPLE_MAX_BUCKETS, default 2000); finer requests
+// are coarsened to fit.
+var maxDownsampleBuckets = 2000
+
+// bucketEpoch is where $dateTrunc starts counting bins of a binSize for
+// units of a day and below.
+var bucketEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// alignBucket returns the start of the bucket holding t, on the same grid
+// $dateTrunc uses.
+func alignBucket(t time.Time, bucket time.Duration) time.Time {
+	offset := t.Sub(bucketEpoch)
+	aligned := offset - offset%bucket
+	if offset%bucket < 0 {
+		aligned -= bucket
+	}
+	return bucketEpoch.Add(aligned)
+}
+
+// bucketCount returns how many buckets of the given size cover from to to,
+// both inclusive.
+func bucketCount(from, to time.Time, bucket time.Duration) int64 {
+	return int64(alignBucket(to, bucket).Sub(alignBucket(from, bucket))/bucket) + 1
+}
+
+// coarsenBucket returns the smallest whole multiple of bucket that covers
+// from to to in at most maxBuckets buckets, bucket itself when it already
+// does. Multiples keep the result on a $dateTrunc unit.
+func coarsenBucket(from, to time.Time, bucket time.Duration, maxBuckets int) time.Duration {
+	n := bucketCount(from, to, bucket)
+	if n <= int64(maxBuckets) {
+		return bucket
+	}
+	factor := (n + int64(maxBuckets) - 1) / int64(maxBuckets)
+	coarse := bucket * time.Duration(factor)
+	// realigning to the coarser grid can add a bucket at either end
+	for bucketCount(from, to, coarse) > int64(maxBuckets) {
+		factor++
+		coarse = bucket * time.Duration(factor)
+	}
+	return coarse
+}
+
+// bucketFiller passes buckets on to emit with empty ones (count 0, no
+// averages) added for the intervals that had no readings, for fill=zero.
+// The series starts at from's bucket and ends at to's, or at the first and
+// last bucket with readings when either is zero.
+type bucketFiller struct {
+	bucket time.Duration
+	emit   func(SensorBucket) error
+	// next is the start of the next bucket the series needs; zero until the
+	// first is known
+	next time.Time
+}
+
+func newBucketFiller(from time.Time, bucket time.Duration, emit func(SensorBucket) error) *bucketFiller {
+	f := &bucketFiller{bucket: bucket, emit: emit}
+	if !from.IsZero() {
+		f.next = alignBucket(from, bucket)
+	}
+	return f
+}
+
+// add emits the empty buckets before b, then b.
+func (f *bucketFiller) add(b SensorBucket) error {
+	if err := f.fillUntil(b.Start); err != nil {
+		return err
+	}
+	f.next = b.Start.Add(f.bucket)
+	return f.emit(b)
+}
+
+// finish emits the empty buckets after the last one added, up to and
+// including to's bucket.
+func (f *bucketFiller) finish(to time.Time) error {
+	if to.IsZero() || f.next.IsZero() {
+		return nil
+	}
+	return f.fillUntil(alignBucket(to, f.bucket).Add(f.bucket))
+}
+
+func (f *bucketFiller) fillUntil(end time.Time) error {
+	if f.next.IsZero() {
+		return nil
+	}
+	for ; f.next.Before(end); f.next = f.next.Add(f.bucket) {
+		if err := f.emit(SensorBucket{Start: f.next}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
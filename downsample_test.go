@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlignBucketMatchesDateTruncGrid(t *testing.T) {
+	cases := []struct {
+		t      time.Time
+		bucket time.Duration
+		want   time.Time
+	}{
+		{time.Date(2024, 3, 1, 10, 7, 30, 0, time.UTC), 5 * time.Minute, time.Date(2024, 3, 1, 10, 5, 0, 0, time.UTC)},
+		// bins of 7h count from 2000-01-01, not from midnight
+		{time.Date(2000, 1, 2, 0, 30, 0, 0, time.UTC), 7 * time.Hour, time.Date(2000, 1, 1, 21, 0, 0, 0, time.UTC)},
+		{time.Date(1999, 12, 31, 23, 59, 0, 0, time.UTC), time.Hour, time.Date(1999, 12, 31, 23, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		if got := alignBucket(tc.t, tc.bucket); !got.Equal(tc.want) {
+			t.Errorf("alignBucket(%v, %v) = %v, want %v", tc.t, tc.bucket, got, tc.want)
+		}
+	}
+}
+
+func TestBucketFillerFillsGaps(t *testing.T) {
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	avg := 20.0
+
+	var got []SensorBucket
+	f := newBucketFiller(at(2), 5*time.Minute, func(b SensorBucket) error {
+		got = append(got, b)
+		return nil
+	})
+	for _, start := range []int{5, 15} {
+		if err := f.add(SensorBucket{Start: at(start), Count: 3, AvgTemperature: &avg, AvgHumidity: &avg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.finish(at(22)); err != nil {
+		t.Fatal(err)
+	}
+
+	wantCounts := map[int]int64{0: 0, 5: 3, 10: 0, 15: 3, 20: 0}
+	if len(got) != len(wantCounts) {
+		t.Fatalf("got %d buckets, want %d: %+v", len(got), len(wantCounts), got)
+	}
+	for i, b := range got {
+		start := i * 5
+		if !b.Start.Equal(at(start)) || b.Count != wantCounts[start] {
+			t.Fatalf("bucket %d = %v with %d readings, want %v with %d", i, b.Start, b.Count, at(start), wantCounts[start])
+		}
+		if b.Count == 0 && (b.AvgTemperature != nil || b.AvgHumidity != nil) {
+			t.Fatalf("empty bucket %v has averages", b.Start)
+		}
+	}
+	if n := bucketCount(at(2), at(22), 5*time.Minute); n != int64(len(got)) {
+		t.Fatalf("bucketCount = %d, want %d", n, len(got))
+	}
+}
+
+func TestCoarsenBucketKeepsUnderMax(t *testing.T) {
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, 0)
+
+	if got := coarsenBucket(from, to, time.Hour, 10000); got != time.Hour {
+		t.Fatalf("bucket that already fits was coarsened to %v", got)
+	}
+	// a year of minutes is ~525k buckets
+	got := coarsenBucket(from, to, time.Minute, 2000)
+	if got%time.Minute != 0 || got <= time.Minute {
+		t.Fatalf("coarsened bucket = %v, want a larger whole number of minutes", got)
+	}
+	if n := bucketCount(from, to, got); n > 2000 {
+		t.Fatalf("coarsened bucket %v still gives %d buckets", got, n)
+	}
+	if n := bucketCount(from, to, got-time.Minute); n <= 2000 {
+		t.Fatalf("coarsened bucket %v is not the smallest that fits", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func getEnvFloatList(key string, fallback []float64) []float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	var values []float64
+	for _, part := range strings.Split(raw, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			logger.Fatal("invalid value for "+key, zap.String("value", raw), zap.Error(err))
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func getEnvInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.Fatal("invalid value for "+key, zap.String("value", raw), zap.Error(err))
+	}
+	return v
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		logger.Fatal("invalid value for "+key, zap.String("value", raw), zap.Error(err))
+	}
+	return v
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		logger.Fatal("invalid value for "+key, zap.String("value", raw), zap.Error(err))
+	}
+	return v
+}
+
+func getEnvString(key, fallback string) string {
+	if raw := os.Getenv(key); raw != "" {
+		return raw
+	}
+	return fallback
+}
+
+// getEnvNonEmpty is like getEnvString but treats a variable that is set to
+// an empty value as a configuration mistake rather than a request for the
+// default.
+func getEnvNonEmpty(key, fallback string) string {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	if raw == "" {
+		logger.Fatal("$" + key + " is set but empty; unset it to use the default " + fallback)
+	}
+	return raw
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		logger.Fatal("invalid value for "+key, zap.String("value", raw), zap.Error(err))
+	}
+	return v
+}
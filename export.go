@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Streaming exports can outlive the shutdown grace period. They register
+// here so shutdown can give them EXPORT_DRAIN_TIMEOUT to finish and then
+// cut off the rest cleanly, with a marker, rather than leave clients holding
+// a partial file that looks complete.
+var (
+	// exportsMu guards exportsClosed; trackExport holds it while adding to
+	// exportsWG so no export starts once drainExports is waiting.
+	exportsMu     sync.Mutex
+	exportsClosed bool
+	exportsWG     sync.WaitGroup
+
+	// exportsCtx is cancelled when the drain timeout runs out.
+	exportsCtx, truncateExports = context.WithCancel(context.Background())
+)
+
+// trackExport registers a running export. The returned context is cancelled
+// when ctx is or when shutdown stops waiting for exports, and done must be
+// called once the export has finished writing. It returns ok false once
+// shutdown has started.
+func trackExport(ctx context.Context) (exportCtx context.Context, done func(), ok bool) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if exportsClosed {
+		return nil, nil, false
+	}
+	exportsWG.Add(1)
+	activeExports.Inc()
+	exportCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-exportsCtx.Done():
+			cancel()
+		case <-exportCtx.Done():
+		}
+	}()
+	return exportCtx, func() {
+		cancel()
+		activeExports.Dec()
+		exportsWG.Done()
+	}, true
+}
+
+// exportTruncatedByShutdown reports whether running exports have been told
+// to stop because the drain timeout ran out.
+func exportTruncatedByShutdown() bool {
+	return exportsCtx.Err() != nil
+}
+
+// drainExports stops new exports, waits up to timeout for running ones to
+// finish, then cancels the rest and waits for them to write their
+// truncation marker.
+func drainExports(timeout time.Duration) {
+	exportsMu.Lock()
+	exportsClosed = true
+	exportsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		exportsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	logger.Warn("exports still running after drain timeout; truncating them", zap.Duration("timeout", timeout))
+	truncateExports()
+	<-done
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// An export still running when the drain timeout runs out must be told to
+// stop, and shutdown must wait for it to do so; exports started afterwards
+// are refused.
+func TestDrainExportsTruncatesSlowExports(t *testing.T) {
+	t.Cleanup(func() {
+		exportsClosed = false
+		exportsCtx, truncateExports = context.WithCancel(context.Background())
+	})
+
+	ctx, done, ok := trackExport(context.Background())
+	if !ok {
+		t.Fatal("export refused before shutdown")
+	}
+	finished := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(finished)
+		done()
+	}()
+
+	drainExports(10 * time.Millisecond)
+	select {
+	case <-finished:
+	default:
+		t.Fatal("drainExports returned before the export stopped")
+	}
+	if !exportTruncatedByShutdown() {
+		t.Fatal("exportTruncatedByShutdown = false after the drain timeout")
+	}
+	if _, _, ok := trackExport(context.Background()); ok {
+		t.Fatal("export started after shutdown began")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Fault detection flags readings that look like a disconnected or broken
+// sensor rather than a real measurement. FAULT_DETECTION_MODE selects what
+// happens to them: "off" (default), "tag" stores them with suspected_fault
+// set, and "reject" refuses them.
+const (
+	faultModeOff    = "off"
+	faultModeTag    = "tag"
+	faultModeReject = "reject"
+)
+
+var faultDetectionMode = faultModeOff
+
+// faultTempLimits and faultHumidityLimits are the sensor's [min, max]
+// output range (FAULT_TEMP_LIMITS, FAULT_HUMIDITY_LIMITS). A reading pinned
+// at either end is suspicious. The checks are skipped when unset.
+var (
+	faultTempLimits     []float64
+	faultHumidityLimits []float64
+)
+
+func configureFaultDetection() {
+	faultDetectionMode = getEnvString("FAULT_DETECTION_MODE", faultModeOff)
+	switch faultDetectionMode {
+	case faultModeOff, faultModeTag, faultModeReject:
+	default:
+		logger.Fatal("$FAULT_DETECTION_MODE must be one of off, tag, reject")
+	}
+	faultTempLimits = getEnvFloatList("FAULT_TEMP_LIMITS", nil)
+	faultHumidityLimits = getEnvFloatList("FAULT_HUMIDITY_LIMITS", nil)
+	if (faultTempLimits != nil && len(faultTempLimits) != 2) || (faultHumidityLimits != nil && len(faultHumidityLimits) != 2) {
+		logger.Fatal("$FAULT_TEMP_LIMITS and $FAULT_HUMIDITY_LIMITS must be \"min,max\"")
+	}
+}
+
+// detectSensorFault returns why the reading looks like a sensor fault, or
+// an empty string when it looks like a real reading.
+func detectSensorFault(temperature, humidity float64) string {
+	if faultDetectionMode == faultModeOff {
+		return ""
+	}
+	if temperature == 0 && humidity == 0 {
+		return "temperature and humidity are both exactly 0"
+	}
+	if isPinned(temperature, faultTempLimits) {
+		return fmt.Sprintf("temperature pinned at sensor limit %v", temperature)
+	}
+	if isPinned(humidity, faultHumidityLimits) {
+		return fmt.Sprintf("humidity pinned at sensor limit %v", humidity)
+	}
+	return ""
+}
+
+func isPinned(value float64, limits []float64) bool {
+	return len(limits) == 2 && (value == limits[0] || value == limits[1])
+}
+
+// screenSensorFault runs fault detection on payload for a write handler. A
+// suspected fault is logged and then either tagged on payload or, in reject
+// mode, answered with 422; extra is added to both the log line and the
+// response, e.g. the index within a batch. It reports whether the handler
+// should carry on.
+func screenSensorFault(c *gin.Context, payload *SensorDataPayload, extra gin.H) bool {
+	reason := detectSensorFault(*payload.Temperature, *payload.Humidity)
+	if reason == "" {
+		return true
+	}
+	fields := []zap.Field{zap.String("reason", reason), zap.String("device_id", payload.DeviceID),
+		zap.Float64("temperature", *payload.Temperature), zap.Float64("humidity", *payload.Humidity)}
+	for k, v := range extra {
+		fields = append(fields, zap.Any(k, v))
+	}
+	loggerFor(c).Warn("suspected sensor fault", fields...)
+	if faultDetectionMode == faultModeReject {
+		body := gin.H{"error": "suspected sensor fault: " + reason, "suspected_fault": true}
+		for k, v := range extra {
+			body[k] = v
+		}
+		respondJSON(c, http.StatusUnprocessableEntity, body)
+		return false
+	}
+	payload.SuspectedFault = true
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// seqMax is the largest sequence number a device sends before its counter
+// wraps back to 0 (SEQ_MAX, default that of a uint32 counter).
+var seqMax int64 = 1<<32 - 1
+
+// SequenceGap is a run of sequence numbers that never arrived, From and To
+// inclusive. A gap that spans the wraparound has To < From.
+type SequenceGap struct {
+	From    int64 `json:"from"`
+	To      int64 `json:"to"`
+	Missing int64 `json:"missing"`
+}
+
+// sensorSequences returns the seq of up to limit readings matching filter,
+// in arrival order. Readings sent without a seq are skipped. Readings from
+// one batch share a timestamp, so seq breaks the tie.
+func sensorSequences(ctx context.Context, mc *mongo.Collection, filter bson.M, limit int) ([]int64, error) {
+	filter["seq"] = bson.M{"$exists": true}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "seq", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"_id": 0, "seq": 1})
+	cursor, err := mc.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		Seq int64 `bson:"seq"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	seqs := make([]int64, len(rows))
+	for i, row := range rows {
+		seqs[i] = row.Seq
+	}
+	return seqs, nil
+}
+
+// findSequenceGaps reports the sequence numbers missing from seqs, which
+// count up to max and then wrap to 0. Each seq is first unwrapped onto an
+// ever-increasing counter, taking whichever wrap puts it closest to the
+// highest seen so far: a drop from near max to near 0 is a wraparound,
+// while a small drop is a late or retransmitted reading that may fill an
+// earlier hole. The gaps between the sorted unwrapped values are what went
+// missing.
+func findSequenceGaps(seqs []int64, max int64) []SequenceGap {
+	gaps := []SequenceGap{}
+	if len(seqs) == 0 {
+		return gaps
+	}
+	span := max + 1
+	unwrapped := make([]int64, len(seqs))
+	highest := seqs[0]
+	for i, seq := range seqs {
+		u := highest - wrapSeq(highest, span) + seq
+		if u-highest > span/2 {
+			u -= span
+		} else if highest-u > span/2 {
+			u += span
+		}
+		unwrapped[i] = u
+		if u > highest {
+			highest = u
+		}
+	}
+	sort.Slice(unwrapped, func(i, j int) bool { return unwrapped[i] < unwrapped[j] })
+	for i := 1; i < len(unwrapped); i++ {
+		prev, seq := unwrapped[i-1], unwrapped[i]
+		if seq-prev <= 1 {
+			continue
+		}
+		gaps = append(gaps, SequenceGap{From: wrapSeq(prev+1, span), To: wrapSeq(seq-1, span), Missing: seq - prev - 1})
+	}
+	return gaps
+}
+
+// wrapSeq maps an unwrapped counter value back onto [0, span).
+func wrapSeq(u, span int64) int64 {
+	return (u%span + span) % span
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindSequenceGaps(t *testing.T) {
+	cases := []struct {
+		name string
+		seqs []int64
+		max  int64
+		want []SequenceGap
+	}{
+		{"contiguous", []int64{1, 2, 3}, 100, []SequenceGap{}},
+		{"retransmit", []int64{1, 2, 2, 3}, 100, []SequenceGap{}},
+		{"single gap", []int64{1, 2, 5, 6}, 100, []SequenceGap{{From: 3, To: 4, Missing: 2}}},
+		{"clean wraparound", []int64{99, 100, 0, 1}, 100, []SequenceGap{}},
+		{"gap across wraparound", []int64{98, 2}, 100, []SequenceGap{{From: 99, To: 1, Missing: 4}}},
+		{"gap ending at wraparound", []int64{98, 0}, 100, []SequenceGap{{From: 99, To: 100, Missing: 2}}},
+		{"out of order", []int64{5, 7, 6}, 100, []SequenceGap{}},
+		{"out of order with a uint32 counter", []int64{5, 7, 6}, 1<<32 - 1, []SequenceGap{}},
+		{"late reading fills part of a gap", []int64{5, 9, 7}, 100, []SequenceGap{{From: 6, To: 6, Missing: 1}, {From: 8, To: 8, Missing: 1}}},
+		{"out of order across wraparound", []int64{99, 0, 100, 1}, 100, []SequenceGap{}},
+		{"late reading from before wraparound", []int64{98, 0, 1, 100}, 100, []SequenceGap{{From: 99, To: 99, Missing: 1}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := findSequenceGaps(tc.seqs, tc.max); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("findSequenceGaps(%v) = %v, want %v", tc.seqs, got, tc.want)
+			}
+		})
+	}
+}
@@ -1,40 +1,78 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 
 	"os/signal"
+	"regexp"
 	"syscall"
 
+	"net"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"context"
+	_ "embed"
 
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"go.uber.org/zap"
 )
 
 type SensorData struct {
 	Id          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	DeviceID    string             `json:"device_id" bson:"device_id"`
 	Temperature float64            `json:"temperature" bson:"temperature"`
 	Humidity    float64            `json:"humidity" bson:"humidity"`
 	Timestamp   time.Time          `json:"timestamp" bson:"timestamp"`
+	// Quality is the sensor's self-assessed confidence (0-100). Readings
+	// without one are treated as full confidence.
+	Quality        *float64 `json:"quality,omitempty" bson:"quality,omitempty"`
+	SuspectedFault bool     `json:"suspected_fault,omitempty" bson:"suspected_fault,omitempty"`
+	// Seq is the device's own per-reading counter, used to spot readings
+	// lost on the way (see /sensor/gaps).
+	Seq *int64 `json:"seq,omitempty" bson:"seq,omitempty"`
+	// Raw holds the values as sent when the reading was calibrated and
+	// CALIBRATION_KEEP_RAW is set.
+	Raw *RawReading `json:"raw,omitempty" bson:"raw,omitempty"`
 }
 
+// SensorDataPayload uses pointers so that "required" only rejects missing
+// fields and a legitimate 0 reading is accepted. Ranges are checked by
+// validatePayload.
 type SensorDataPayload struct {
-	Temperature float64 `json:"temperature" binding:"required"`
-	Humidity    float64 `json:"humidity" binding:"required"`
+	DeviceID    string   `json:"device_id" binding:"required,max=64"`
+	Temperature *float64 `json:"temperature" binding:"required"`
+	Humidity    *float64 `json:"humidity" binding:"required"`
+	Quality     *float64 `json:"quality" binding:"omitempty,min=0,max=100"`
+	Seq         *int64   `json:"seq" binding:"omitempty,min=0"`
+	// SuspectedFault is set server-side by fault detection
+	SuspectedFault bool `json:"-"`
 }
 
 type SensorDataRequest struct {
@@ -44,20 +82,235 @@ type SensorDataRequest struct {
 }
 type SensorDataResponse struct {
 	InsertedId *InsertedId
-	Err        error
+	// Data is the stored reading, including its id and server timestamp.
+	Data *SensorData
+	Err  error
 }
 type InsertedId primitive.ObjectID
 
+// DeviceMetadata holds slowly-changing per-device info, kept in its own
+// collection apart from the high-volume readings.
+type DeviceMetadata struct {
+	DeviceID        string `json:"device_id" bson:"_id"`
+	Name            string `json:"name" bson:"name"`
+	Location        string `json:"location" bson:"location"`
+	FirmwareVersion string `json:"firmware_version" bson:"firmware_version"`
+	// Calibration is applied to the device's readings on ingest when
+	// CALIBRATION_ENABLED is set.
+	Calibration *Calibration `json:"calibration,omitempty" bson:"calibration,omitempty"`
+	UpdatedAt   time.Time    `json:"updated_at" bson:"updated_at"`
+}
+
+type DeviceMetadataPayload struct {
+	Name            string       `json:"name" binding:"required,max=100"`
+	Location        string       `json:"location" binding:"max=100"`
+	FirmwareVersion string       `json:"firmware_version" binding:"max=50"`
+	Calibration     *Calibration `json:"calibration"`
+}
+
+var deviceIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+type SensorPercentile struct {
+	P     float64  `json:"p"`
+	Value *float64 `json:"value"`
+}
+
+type SensorStats struct {
+	Count          int64   `json:"count" bson:"count"`
+	AvgTemperature float64 `json:"avg_temperature" bson:"avg_temperature"`
+	MinTemperature float64 `json:"min_temperature" bson:"min_temperature"`
+	MaxTemperature float64 `json:"max_temperature" bson:"max_temperature"`
+	AvgHumidity    float64 `json:"avg_humidity" bson:"avg_humidity"`
+	MinHumidity    float64 `json:"min_humidity" bson:"min_humidity"`
+	MaxHumidity    float64 `json:"max_humidity" bson:"max_humidity"`
+}
+
+// SensorRate is the slope between a reading and the one before it, in units
+// of the field per second. Rate is null when both share a timestamp.
+type SensorRate struct {
+	Timestamp time.Time `json:"timestamp"`
+	Rate      *float64  `json:"rate"`
+}
+
+// SensorBucket averages the readings whose timestamp falls in the bucket
+// starting at Start. The averages are null for an empty bucket, which only
+// appears with fill=zero.
+type SensorBucket struct {
+	Start          time.Time `json:"start" bson:"_id"`
+	Count          int64     `json:"count" bson:"count"`
+	AvgTemperature *float64  `json:"avg_temperature" bson:"avg_temperature"`
+	AvgHumidity    *float64  `json:"avg_humidity" bson:"avg_humidity"`
+}
+
+type BackfillReading struct {
+	DeviceID    string    `json:"device_id"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type BackfillResult struct {
+	Index      int    `json:"index"`
+	InsertedId string `json:"inserted_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
 var SensorDataPayloads = make(chan SensorDataRequest)
 
-var clients []*websocket.Conn
+// payloadsMu guards closing SensorDataPayloads at shutdown: senders hold the
+// read lock while sending so the channel is never closed under them.
+var (
+	payloadsMu     sync.RWMutex
+	payloadsClosed bool
+
+	// shuttingDown is set once SIGTERM arrives; drainedCount counts the
+	// inserts completed after that point.
+	shuttingDown atomic.Bool
+	drainedCount atomic.Int64
+)
+
+// enqueueSensorData hands req to the insert workers. It returns false once
+// shutdown has closed the queue.
+func enqueueSensorData(req SensorDataRequest) bool {
+	payloadsMu.RLock()
+	defer payloadsMu.RUnlock()
+	if payloadsClosed {
+		return false
+	}
+	SensorDataPayloads <- req
+	return true
+}
+
+// closeSensorDataPayloads stops accepting new inserts. Workers finish what
+// is already queued and then exit.
+func closeSensorDataPayloads() {
+	payloadsMu.Lock()
+	defer payloadsMu.Unlock()
+	payloadsClosed = true
+	close(SensorDataPayloads)
+}
+
+// ready is flipped once startup (Mongo connect and ping) has completed, so
+// the HTTP server can come up early for probes without serving traffic.
+var ready atomic.Bool
+
+// historyChunkSize is how many readings go in each message of the initial
+// websocket dump (WS_HISTORY_CHUNK_SIZE).
+var historyChunkSize = 25
+
+// historyQueryTimeout bounds the query behind the initial websocket dump
+// (WS_HISTORY_TIMEOUT) so a hung read can't pin the connection's goroutine.
+var historyQueryTimeout = 5 * time.Second
+
+// broadcastIngestLag adds ingest_lag_ms to live broadcasts
+// (BROADCAST_INGEST_LAG).
+var broadcastIngestLag bool
+
+// wsPingInterval is how often the server pings each websocket client
+// (WS_PING_INTERVAL), and wsPongWait how long it waits for any pong before
+// dropping the connection (WS_PONG_WAIT). wsPongWait must exceed the
+// interval.
+var (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+)
+
+// wsWriteWait is how long a single data frame may take to write before the
+// client is treated as dead (WS_WRITE_TIMEOUT, default 10s). wsReadLimit
+// caps the size of a frame a client may send (WS_READ_LIMIT, default 4KiB);
+// clients only send small control messages, so anything bigger is refused
+// and the connection closed.
+var (
+	wsWriteWait       = 10 * time.Second
+	wsReadLimit int64 = 4096
+)
+
+// wsReconnectBase is the shortest reconnect delay suggested to clients in
+// the going-away close frame (WS_RECONNECT_BASE, default 1s).
+var wsReconnectBase = time.Second
+
+// broadcastConcurrency bounds how many clients a broadcast writes to at once
+// (BROADCAST_CONCURRENCY).
+var broadcastConcurrency = 8
+
+// wsClient serialises writes to one connection: gorilla/websocket allows
+// only a single concurrent writer, and the initial dump, live broadcasts and
+// the read loop's replies can all write to the same connection at once. All
+// data frames must go through writeJSON or writeMessage; only WriteControl
+// and Close may be called on conn directly, as gorilla allows those
+// concurrently. Holding mu for a whole message means frames of concurrent
+// broadcasts never interleave, which a per-client writer goroutine draining
+// a queue would equally guarantee if the hub is ever reworked that way.
+type wsClient struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+	// deviceID, when set, restricts the snapshot and live readings sent to
+	// this client to one device. It starts from the connect URL and is
+	// changed by subscribe/unsubscribe commands, so it is guarded by
+	// filterMu rather than mu.
+	filterMu sync.Mutex
+	deviceID string
+}
+
+func (wc *wsClient) device() string {
+	wc.filterMu.Lock()
+	defer wc.filterMu.Unlock()
+	return wc.deviceID
+}
+
+func (wc *wsClient) setDevice(deviceId string) {
+	wc.filterMu.Lock()
+	defer wc.filterMu.Unlock()
+	wc.deviceID = deviceId
+}
+
+// wants reports whether a reading should be sent to this client.
+func (wc *wsClient) wants(data *SensorData) bool {
+	deviceId := wc.device()
+	return deviceId == "" || deviceId == data.DeviceID
+}
+
+// writeJSON encodes v before taking the connection, so a value that can't
+// be encoded fails without any part of a frame reaching the client.
+func (wc *wsClient) writeJSON(v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errWSEncode, err)
+	}
+	return wc.writeMessage(websocket.TextMessage, payload)
+}
+
+// errWSEncode marks a message that couldn't be encoded; nothing was written
+// and the connection is still usable.
+var errWSEncode = errors.New("encoding websocket message")
+
+// isPermanentWSWriteError reports whether a failed write left the
+// connection unusable. gorilla/websocket fails every write after one that
+// failed on the network, deadline timeouts included, so only errors raised
+// before anything was written are temporary.
+func isPermanentWSWriteError(err error) bool {
+	return !errors.Is(err, errWSEncode)
+}
+
+func (wc *wsClient) writeMessage(messageType int, data []byte) error {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return wc.conn.WriteMessage(messageType, data)
+}
+
+// clients is guarded by lock, which only protects the slice itself and is
+// never held across network writes.
+var clients []*wsClient
 var lock sync.Mutex
 
+// websocketUpgrader's buffer sizes default to 1KiB and can be changed with
+// WS_READ_BUFFER_SIZE and WS_WRITE_BUFFER_SIZE.
 var websocketUpgrader = &websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return liveConfig().cors.checkOrigin(r)
 	},
 }
 
@@ -69,8 +322,51 @@ var logger *zap.Logger = func() *zap.Logger {
 	return logger
 }()
 
+// stepdownRetries and stepdownBackoff bound how long an insert waits for a
+// new primary after a replica-set election (INSERT_STEPDOWN_RETRIES,
+// INSERT_STEPDOWN_BACKOFF). The backoff doubles after each attempt.
+var (
+	stepdownRetries = 3
+	stepdownBackoff = 200 * time.Millisecond
+)
+
+// stepdownErrorCodes are the server codes returned while a replica set has
+// no writable primary. They clear once an election completes.
+var stepdownErrorCodes = []int{
+	10107, // NotWritablePrimary
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+	189,   // PrimarySteppedDown
+	11602, // InterruptedDueToReplStateChange
+}
+
+func isStepdownError(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	for _, code := range stepdownErrorCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
 func addSensorData(ctx context.Context, mc *mongo.Collection, data *SensorData) (primitive.ObjectID, error) {
 	res, err := mc.InsertOne(ctx, data)
+	backoff := stepdownBackoff
+	for attempt := 1; err != nil && isStepdownError(err) && attempt <= stepdownRetries; attempt++ {
+		logger.Warn("insert failed during primary stepdown, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		insertStepdownRetries.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return primitive.NilObjectID, ctx.Err()
+		}
+		backoff *= 2
+		res, err = mc.InsertOne(ctx, data)
+	}
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
@@ -81,226 +377,2634 @@ func addSensorData(ctx context.Context, mc *mongo.Collection, data *SensorData)
 	return insertedId, nil
 }
 
+// Plausible physical ranges for a reading; anything outside is a broken
+// sensor or a bad client rather than a measurement worth storing.
+const (
+	minTemperature = -100.0
+	maxTemperature = 100.0
+	minHumidity    = 0.0
+	maxHumidity    = 100.0
+)
+
+// validatePayload checks a payload as sent. The temperature and humidity
+// ranges are checked by prepareSensorData instead, once any calibration has
+// been applied, so a device reporting in other units isn't rejected.
+func validatePayload(payload SensorDataPayload) error {
+	if !deviceIdPattern.MatchString(payload.DeviceID) {
+		return errors.New("invalid device id")
+	}
+	if payload.Seq != nil && (*payload.Seq < 0 || *payload.Seq > seqMax) {
+		return fmt.Errorf("seq %d must be between 0 and %d", *payload.Seq, seqMax)
+	}
+	return nil
+}
+
+// rangeError lists the fields of a reading that are out of range. Handlers
+// answer it with 400, unlike storage errors.
+type rangeError []string
+
+func (e rangeError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// prepareSensorData applies the device's calibration to data and checks the
+// calibrated values are in range, returning a rangeError when they aren't.
+func prepareSensorData(ctx context.Context, data *SensorData) error {
+	if err := calibrations.apply(ctx, data); err != nil {
+		return err
+	}
+	return validateReadingRange(data.Temperature, data.Humidity)
+}
+
+// validateReadingRange reports every field that is out of range.
+func validateReadingRange(temperature, humidity float64) error {
+	var problems []string
+	if temperature < minTemperature || temperature > maxTemperature {
+		problems = append(problems, fmt.Sprintf("temperature %v must be between %v and %v", temperature, minTemperature, maxTemperature))
+	}
+	if humidity < minHumidity || humidity > maxHumidity {
+		problems = append(problems, fmt.Sprintf("humidity %v must be between %v and %v", humidity, minHumidity, maxHumidity))
+	}
+	if len(problems) > 0 {
+		return rangeError(problems)
+	}
+	return nil
+}
+
+// addSensorDataBatch inserts data in order with a single InsertMany. Ids are
+// assigned up front, so on success every element has its Id set.
+func addSensorDataBatch(ctx context.Context, mc *mongo.Collection, data []*SensorData) ([]primitive.ObjectID, error) {
+	docs := make([]interface{}, len(data))
+	insertedIds := make([]primitive.ObjectID, len(data))
+	for i, d := range data {
+		d.Id = primitive.NewObjectID()
+		docs[i] = d
+		insertedIds[i] = d.Id
+	}
+	if _, err := mc.InsertMany(ctx, docs); err != nil {
+		return nil, err
+	}
+	return insertedIds, nil
+}
+
+var errInvalidSensorDataId = errors.New("invalid sensor data id")
 
-func getAllSensorData(ctx context.Context, mc *mongo.Collection) ([]*SensorData, error) {
-	var data []*SensorData
-	cursor, err := mc.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetLimit(100))
+func getSensorData(ctx context.Context, mc *mongo.Collection, id string) (*SensorData, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
+		return nil, errInvalidSensorDataId
+	}
+	var data SensorData
+	if err := mc.FindOne(ctx, bson.M{"_id": objectId}).Decode(&data); err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
-	err = cursor.All(ctx, &data)
+	return &data, nil
+}
+
+// updateSensorData replaces a reading's values with those of data and
+// returns the updated document, or mongo.ErrNoDocuments when there is no
+// such reading. The original id and timestamp are kept.
+func updateSensorData(ctx context.Context, mc *mongo.Collection, id string, data *SensorData) (*SensorData, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
+		return nil, errInvalidSensorDataId
+	}
+	set := bson.M{
+		"device_id":   data.DeviceID,
+		"temperature": data.Temperature,
+		"humidity":    data.Humidity,
+	}
+	unset := bson.M{}
+	if data.Quality != nil {
+		set["quality"] = *data.Quality
+	} else {
+		unset["quality"] = ""
+	}
+	if data.SuspectedFault {
+		set["suspected_fault"] = true
+	} else {
+		unset["suspected_fault"] = ""
+	}
+	if data.Seq != nil {
+		set["seq"] = *data.Seq
+	} else {
+		unset["seq"] = ""
+	}
+	if data.Raw != nil {
+		set["raw"] = data.Raw
+	} else {
+		unset["raw"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated SensorData
+	if err := mc.FindOneAndUpdate(ctx, bson.M{"_id": objectId}, update, opts).Decode(&updated); err != nil {
 		return nil, err
 	}
-	return data, nil
+	return &updated, nil
 }
 
-func broadcastAllSensorData(ctx context.Context, mc *mongo.Collection, ws *websocket.Conn) error {
-	data, err := getAllSensorData(ctx, mc)
+// deleteSensorData removes a reading and returns it, so callers know which
+// device it belonged to, or mongo.ErrNoDocuments when there is no such
+// reading.
+func deleteSensorData(ctx context.Context, mc *mongo.Collection, id string) (*SensorData, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		logger.Error("error retrieving all sensor data", zap.Error(err))
-		return err
+		return nil, errInvalidSensorDataId
 	}
-	lock.Lock()
-	defer lock.Unlock()
+	var deleted SensorData
+	if err := mc.FindOneAndDelete(ctx, bson.M{"_id": objectId}).Decode(&deleted); err != nil {
+		return nil, err
+	}
+	return &deleted, nil
+}
 
-	if err := ws.WriteJSON(gin.H{"message": "successfully retrieved sensor data", "data": data}); err != nil {
-		if closeErr := ws.Close(); closeErr != nil {
-			return closeErr
+// addSensorDataBackfill stores historical readings with their original
+// timestamps using an unordered InsertMany, so one bad document doesn't stop
+// the rest of the batch. Ids are assigned up front so every record can be
+// reported back individually. A full batch is a single round trip; expect
+// several thousand readings per second against a healthy replica set.
+func addSensorDataBackfill(ctx context.Context, mc *mongo.Collection, readings []BackfillReading) ([]BackfillResult, error) {
+	results := make([]BackfillResult, len(readings))
+	docs := make([]interface{}, 0, len(readings))
+	docIndex := make([]int, 0, len(readings))
+	for i, reading := range readings {
+		results[i].Index = i
+		if reading.DeviceID == "" {
+			results[i].Error = "device_id is required"
+			continue
+		}
+		if !deviceIdPattern.MatchString(reading.DeviceID) {
+			results[i].Error = "invalid device id"
+			continue
+		}
+		if reading.Timestamp.IsZero() {
+			results[i].Error = "timestamp is required"
+			continue
+		}
+		data := &SensorData{
+			Id:          primitive.NewObjectID(),
+			DeviceID:    reading.DeviceID,
+			Temperature: reading.Temperature,
+			Humidity:    reading.Humidity,
+			Timestamp:   reading.Timestamp.UTC(),
 		}
+		if err := prepareSensorData(ctx, data); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].InsertedId = data.Id.Hex()
+		docs = append(docs, data)
+		docIndex = append(docIndex, i)
+	}
+	if len(docs) == 0 {
+		return results, nil
 	}
 
-	return nil
+	_, err := mc.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			i := docIndex[writeErr.Index]
+			results[i].InsertedId = ""
+			results[i].Error = writeErr.Message
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	for j, doc := range docs {
+		if results[docIndex[j]].Error == "" {
+			readingsEmitter.emit(doc.(*SensorData))
+		}
+	}
+	return results, nil
 }
 
-func broadcastSensorData(ctx context.Context, mc *mongo.Collection, data *SensorData) error {
-	lock.Lock()
-	defer lock.Unlock()
-	for _, ws := range clients {
-		if err := ws.WriteJSON(gin.H{"message": "new sensor data", "data": data}); err != nil {
-			if closeErr := ws.Close(); closeErr != nil {
-				return closeErr
-			}
-		}
+// getAllSensorData returns one page of readings, oldest first. Pages are
+// 1-based.
+func getAllSensorData(ctx context.Context, mc *mongo.Collection, filter bson.M, page, size int) ([]*SensorData, error) {
+	// non-nil so an empty collection marshals to [] rather than null
+	data := []*SensorData{}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetSkip(int64((page - 1) * size)).
+		SetLimit(int64(size))
+	cursor, err := mc.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer cursor.Close(ctx)
+	err = cursor.All(ctx, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-func sendSensorData(ctx context.Context, mc *mongo.Collection, payload SensorDataPayload) (InsertedId, error) {
-	data := &SensorData{
-		Temperature: payload.Temperature,
-		Humidity:    payload.Humidity,
-		Timestamp:   time.Now().UTC(),
+// getDeviceSensorData returns one page of a device's readings, newest
+// first, along with how many readings the device has in total.
+func getDeviceSensorData(ctx context.Context, mc *mongo.Collection, deviceId string, page, size int) ([]*SensorData, int64, error) {
+	filter := bson.M{"device_id": deviceId}
+	total, err := mc.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
 	}
-	insertedId, err := addSensorData(ctx, mc, data)
+	// non-nil so a device without readings marshals to [] rather than null
+	data := []*SensorData{}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetSkip(int64((page - 1) * size)).
+		SetLimit(int64(size))
+	cursor, err := mc.Find(ctx, filter, opts)
 	if err != nil {
-		return InsertedId{}, err
+		return nil, 0, err
 	}
-	data.Id = insertedId
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &data); err != nil {
+		return nil, 0, err
+	}
+	return data, total, nil
+}
 
-	if err := broadcastSensorData(ctx, mc, data); err != nil {
-		return InsertedId{}, err
+func getDevice(ctx context.Context, mc *mongo.Collection, deviceId string) (*DeviceMetadata, error) {
+	var device DeviceMetadata
+	if err := mc.FindOne(ctx, bson.M{"_id": deviceId}).Decode(&device); err != nil {
+		return nil, err
 	}
-	return InsertedId(insertedId), nil
+	return &device, nil
 }
 
-func main() {
-	defer logger.Sync()
-	if err := godotenv.Load(".env"); err != nil {
-		logger.Fatal("Error loading .env file")
+func upsertDevice(ctx context.Context, mc *mongo.Collection, deviceId string, payload DeviceMetadataPayload) (*DeviceMetadata, error) {
+	set := bson.M{
+		"name":             payload.Name,
+		"location":         payload.Location,
+		"firmware_version": payload.FirmwareVersion,
+		"updated_at":       time.Now().UTC(),
+	}
+	update := bson.M{"$set": set}
+	// PUT replaces the metadata, so leaving calibration out removes it
+	if payload.Calibration != nil {
+		set["calibration"] = payload.Calibration
+	} else {
+		update["$unset"] = bson.M{"calibration": ""}
 	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var device DeviceMetadata
+	if err := mc.FindOneAndUpdate(ctx, bson.M{"_id": deviceId}, update, opts).Decode(&device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
 
-	DBURI := os.Getenv("DB_URI")
-	if DBURI == "" {
-		logger.Fatal("$DB_URI must be set")
+func (d *SensorData) fieldValue(field string) float64 {
+	if field == "humidity" {
+		return d.Humidity
 	}
+	return d.Temperature
+}
 
-	mainCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+var errNotEnoughSamples = errors.New("at least two readings are required in the range")
 
-	dbClient, err := mongo.Connect(mainCtx, options.Client().ApplyURI(DBURI))
-	if err != nil {
-		logger.Fatal("error connecting to MongoDB", zap.Error(err))
-	}
-	if err := dbClient.Ping(mainCtx, nil); err != nil {
-		logger.Fatal("failed to ping MongoDB", zap.String("error: ", err.Error()))
-	}
-	logger.Info("mongodb connected")
-	sensorDB := dbClient.Database("sensor-project")
-	sensorCollection := sensorDB.Collection("sensor-data")
+// numericFields are the reading fields that may be used in aggregations.
+var numericFields = map[string]bool{"temperature": true, "humidity": true}
 
-	go func() {
-		for req := range SensorDataPayloads {
-			res := SensorDataResponse{}
-			insertedId, err := sendSensorData(req.Ctx, sensorCollection, req.Payload)
-			if err != nil {
-				logger.Error("error sending sensor data", zap.Error(err))
-				res.Err = err
-			} else {
-				res.InsertedId = &insertedId
-			}
-			req.ResponseChan <- res
+// parseTimeRange reads optional RFC3339 from/to query params. A zero time
+// means the bound was not supplied.
+func parseTimeRange(c *gin.Context) (from, to time.Time, err error) {
+	if raw := c.Query("from"); raw != "" {
+		if from, err = time.Parse(time.RFC3339, raw); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
 		}
-	}()
+	}
+	if raw := c.Query("to"); raw != "" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return time.Time{}, time.Time{}, errors.New("to must not be before from")
+	}
+	return from, to, nil
+}
 
-	r := gin.Default()
-	r.LoadHTMLFiles("./data.html")
-	r.Use(func(c *gin.Context) {
-		c.Header("Content-Type", "application/json")
-		c.Next()
-	})
-	r.NoRoute(func(ctx *gin.Context) {
-		logger.Error("endpoint not found", zap.String("path", ctx.Request.URL.Path))
-		ctx.JSON(404, gin.H{"error": "endpoint not found"})
-	})
-	r.GET("/", func(c *gin.Context) {
-		logger.Info("welcome to iot sensor project api", zap.String("status", "ok"))
-		c.JSON(http.StatusOK, gin.H{"data": "welcome to iot sensor project api"})
-	})
-	r.GET("/health", func(ctx *gin.Context) {
-		logger.Info("health check", zap.String("status", "ok"))
-		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+func timeRangeFilter(from, to time.Time) bson.M {
+	filter := bson.M{}
+	timestamp := bson.M{}
+	if !from.IsZero() {
+		timestamp["$gte"] = from
+	}
+	if !to.IsZero() {
+		timestamp["$lte"] = to
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter
+}
 
-	r.POST("/sensor", func(c *gin.Context) {
-		var payload SensorDataPayload
-		if err := c.ShouldBindJSON(&payload); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		responseChan := make(chan SensorDataResponse, 1) //1 will prevent blocking
+// parseMinQuality reads the optional min_quality query param (0-100).
+func parseMinQuality(c *gin.Context) (float64, error) {
+	raw := c.Query("min_quality")
+	if raw == "" {
+		return 0, nil
+	}
+	minQuality, err := strconv.ParseFloat(raw, 64)
+	if err != nil || minQuality < 0 || minQuality > 100 {
+		return 0, fmt.Errorf("invalid min_quality %q: must be between 0 and 100", raw)
+	}
+	return minQuality, nil
+}
 
-		ctx := c.Request.Context()
-		SensorDataPayloads <- SensorDataRequest{Payload: payload, Ctx: ctx, ResponseChan: responseChan}
-		select {
-		case response := <-responseChan:
-			if response.Err != nil {
-				logger.Error("error sending sensor data", zap.Error(response.Err))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": response.Err.Error()})
-			} else if response.InsertedId != nil {
-				logger.Info("sensor data received", zap.String("inserted_id", primitive.ObjectID(*response.InsertedId).Hex()))
-				c.JSON(http.StatusOK, gin.H{"message": "sensor data received", "inserted_id": primitive.ObjectID(*response.InsertedId).Hex()})
-			}
-		case <-ctx.Done():
-			if ctx.Err() == context.DeadlineExceeded {
-				logger.Error("timeout or context cancelled", zap.Error(ctx.Err()))
-				c.JSON(http.StatusRequestTimeout, gin.H{"error": "request timeout"})
-				return
-			}
-			c.JSON(http.StatusRequestTimeout, gin.H{"error": "request cancelled by client"})
-			return
+// parseDeviceIdQuery reads the optional deviceId query param, also accepted
+// as device_id to match the field name in readings. Any other spelling
+// (deviceid, device-id, ...) is rejected rather than ignored, so a typo
+// can't silently widen the result to every device. An empty result means no
+// device filter was asked for.
+func parseDeviceIdQuery(c *gin.Context) (string, error) {
+	var deviceId string
+	for key, values := range c.Request.URL.Query() {
+		normalized := strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+		if normalized != "deviceid" {
+			continue
 		}
-	})
-	r.GET("ws/sensor", func(c *gin.Context) {
-		wsCtx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		ws, err := websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
-			logger.Error("error upgrading to websocket", zap.Error(err))
-			return
+		if key != "deviceId" && key != "device_id" {
+			return "", fmt.Errorf("unknown parameter %q, use deviceId", key)
 		}
-		defer ws.Close()
-		logger.Info("websocket client connected", zap.String("remote_addr", ws.RemoteAddr().String()))
-		lock.Lock()
-		clients = append(clients, ws)
-		lock.Unlock()
-
-		defer func() {
-			lock.Lock()
-			defer lock.Unlock()
-			for i, client := range clients {
-				if client == ws {
-					clients = append(clients[:i], clients[i+1:]...)
-					break
-				}
+		for _, value := range values {
+			if value == "" {
+				return "", errors.New("deviceId must not be empty")
 			}
-		}()
-		go broadcastAllSensorData(wsCtx, sensorCollection, ws)
-		for {
-			messageType, _, err := ws.ReadMessage()
-			if err != nil {
-				logger.Error("error reading message", zap.Error(err))
-				break
-			}
-			if messageType == websocket.PingMessage {
-				logger.Info("pong...")
-				if err := ws.WriteMessage(websocket.PongMessage, nil); err != nil {
-					logger.Error("error sending pong", zap.Error(err))
-					break
-				}
+			if deviceId != "" && value != deviceId {
+				return "", errors.New("conflicting deviceId values")
 			}
+			deviceId = value
 		}
-	})
-
-	r.GET("/data", func(c *gin.Context) {
-		c.Header("Content-Type", "text/html")
-		c.HTML(http.StatusOK, "data.html", gin.H{})
-	})
+	}
+	if deviceId != "" && !deviceIdPattern.MatchString(deviceId) {
+		return "", errors.New("invalid device id")
+	}
+	return deviceId, nil
+}
 
-	srv := &http.Server{
-		Addr:    ":8000",
-		Handler: r,
+// readingsFilter matches readings in the time range with at least
+// minQuality confidence. Readings stored without a quality always match.
+func readingsFilter(from, to time.Time, minQuality float64) bson.M {
+	filter := timeRangeFilter(from, to)
+	if minQuality > 0 {
+		filter["$or"] = bson.A{
+			bson.M{"quality": bson.M{"$gte": minQuality}},
+			bson.M{"quality": bson.M{"$exists": false}},
+		}
 	}
+	return filter
+}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatal("Server start failed", zap.Error(err))
+// sensorStats summarises readings matching filter. No matches yields zeroed
+// stats rather than an error.
+func sensorStats(ctx context.Context, mc *mongo.Collection, filter bson.M) (*SensorStats, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":             nil,
+			"count":           bson.M{"$sum": 1},
+			"avg_temperature": bson.M{"$avg": "$temperature"},
+			"min_temperature": bson.M{"$min": "$temperature"},
+			"max_temperature": bson.M{"$max": "$temperature"},
+			"avg_humidity":    bson.M{"$avg": "$humidity"},
+			"min_humidity":    bson.M{"$min": "$humidity"},
+			"max_humidity":    bson.M{"$max": "$humidity"},
+		}}},
+	}
+	cursor, err := mc.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	stats := &SensorStats{}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(stats); err != nil {
+			return nil, err
 		}
-	}()
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+// latestSensorDataPerDevice returns the most recent reading of every device,
+// or only of deviceIds when any are given, ordered by device id. Sorting on
+// device_id first lets the device_id + timestamp index serve the sort.
+func latestSensorDataPerDevice(ctx context.Context, mc *mongo.Collection, deviceIds ...string) ([]*SensorData, error) {
+	pipeline := mongo.Pipeline{}
+	if len(deviceIds) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"device_id": bson.M{"$in": deviceIds}}}})
+	}
+	pipeline = append(pipeline, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "device_id", Value: 1}, {Key: "timestamp", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$device_id", "latest": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$latest"}}},
+		{{Key: "$sort", Value: bson.D{{Key: "device_id", Value: 1}}}},
+	}...)
+	cursor, err := mc.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	// non-nil so an empty collection marshals to [] rather than null
+	data := []*SensorData{}
+	if err := cursor.All(ctx, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
 
-	<-quit
-	logger.Info("Shutting down server...")
+// dateTruncUnits are the $dateTrunc units a bucket size can be expressed
+// in, largest first. Weeks and months are left out since they don't have a
+// fixed length (or, for weeks, start day).
+var dateTruncUnits = []struct {
+	unit string
+	size time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+	{"millisecond", time.Millisecond},
+}
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer shutdownCancel()
+// bucketUnit maps a bucket size onto a $dateTrunc unit and binSize, using
+// the largest unit that divides it evenly.
+func bucketUnit(bucket time.Duration) (string, int64, error) {
+	if bucket <= 0 {
+		return "", 0, errors.New("bucket must be positive")
+	}
+	for _, u := range dateTruncUnits {
+		if bucket%u.size == 0 {
+			return u.unit, int64(bucket / u.size), nil
+		}
+	}
+	return "", 0, fmt.Errorf("bucket %v is not a whole number of milliseconds", bucket)
+}
+
+// downsampleSensorData averages readings matching filter into fixed time
+// buckets and hands them to emit oldest first as the cursor yields them, so
+// a long range with fine buckets is never held in memory. It stops at the
+// first error from emit or once ctx is done. $dateTrunc needs MongoDB 5.0.
+func downsampleSensorData(ctx context.Context, mc *mongo.Collection, filter bson.M, unit string, binSize int64, emit func(SensorBucket) error) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":             bson.M{"$dateTrunc": bson.M{"date": "$timestamp", "unit": unit, "binSize": binSize}},
+			"count":           bson.M{"$sum": 1},
+			"avg_temperature": bson.M{"$avg": "$temperature"},
+			"avg_humidity":    bson.M{"$avg": "$humidity"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cursor, err := mc.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer closeCursor(cursor)
+	for cursor.Next(ctx) {
+		// Next doesn't consult ctx while it still has buckets buffered
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var bucket SensorBucket
+		if err := cursor.Decode(&bucket); err != nil {
+			return err
+		}
+		if err := emit(bucket); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// closeCursor closes cursor, killing it on the server, under its own
+// deadline: the caller's context may be the cancellation that stopped the
+// iteration.
+func closeCursor(cursor *mongo.Cursor) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cursor.Close(ctx); err != nil {
+		logger.Warn("error closing cursor", zap.Error(err))
+	}
+}
+
+// sensorPercentiles computes the requested percentiles of field in Go over a
+// random sample of at most maxSamples readings, since $percentile needs
+// MongoDB 7.0. Values are linearly interpolated between the closest ranks.
+func sensorPercentiles(ctx context.Context, mc *mongo.Collection, field string, filter bson.M, ps []float64, maxSamples int) (int, []SensorPercentile, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sample", Value: bson.M{"size": maxSamples}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "value": "$" + field}}},
+	}
+	cursor, err := mc.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		Value float64 `bson:"value"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return 0, nil, err
+	}
+
+	values := make([]float64, len(rows))
+	for i, row := range rows {
+		values[i] = row.Value
+	}
+	sort.Float64s(values)
+
+	percentiles := make([]SensorPercentile, len(ps))
+	for i, p := range ps {
+		percentiles[i].P = p
+		if len(values) == 0 {
+			continue
+		}
+		rank := p / 100 * float64(len(values)-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		value := values[lower] + (values[upper]-values[lower])*(rank-float64(lower))
+		percentiles[i].Value = &value
+	}
+	return len(values), percentiles, nil
+}
+
+func sensorRateOfChange(ctx context.Context, mc *mongo.Collection, field string, filter bson.M, limit int) ([]SensorRate, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"timestamp": 1, field: 1})
+	cursor, err := mc.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var rows []*SensorData
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, errNotEnoughSamples
+	}
+
+	rates := make([]SensorRate, 0, len(rows)-1)
+	for i := 1; i < len(rows); i++ {
+		prev, cur := rows[i-1], rows[i]
+		rate := SensorRate{Timestamp: cur.Timestamp.UTC()}
+		if dt := cur.Timestamp.Sub(prev.Timestamp).Seconds(); dt > 0 {
+			slope := (cur.fieldValue(field) - prev.fieldValue(field)) / dt
+			rate.Rate = &slope
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// querySensorData returns up to limit readings matching filter, oldest
+// first.
+func querySensorData(ctx context.Context, mc *mongo.Collection, filter bson.M, limit int) ([]*SensorData, error) {
+	data := []*SensorData{}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := mc.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// exportSensorDataCSV streams readings matching filter to w as CSV, oldest
+// first, writing rows as the cursor advances so memory stays flat however
+// large the export is. flush is called periodically to push rows to the
+// client.
+func exportSensorDataCSV(ctx context.Context, mc *mongo.Collection, filter bson.M, w io.Writer, flush func()) (int, error) {
+	cursor, err := mc.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "deviceId", "temperature", "humidity", "timestamp"}); err != nil {
+		return 0, err
+	}
+	rows := 0
+	for cursor.Next(ctx) {
+		var data SensorData
+		if err := cursor.Decode(&data); err != nil {
+			return rows, err
+		}
+		record := []string{
+			data.Id.Hex(),
+			data.DeviceID,
+			strconv.FormatFloat(data.Temperature, 'f', -1, 64),
+			strconv.FormatFloat(data.Humidity, 'f', -1, 64),
+			data.Timestamp.UTC().Format(time.RFC3339),
+		}
+		if err := cw.Write(record); err != nil {
+			return rows, err
+		}
+		rows++
+		if rows%500 == 0 {
+			cw.Flush()
+			flush()
+		}
+	}
+	cw.Flush()
+	flush()
+	if err := cw.Error(); err != nil {
+		return rows, err
+	}
+	return rows, cursor.Err()
+}
+
+func broadcastAllSensorData(ctx context.Context, store SensorStore, client *wsClient) error {
+	filter := SensorFilter{DeviceID: client.device()}
+	// derived from ctx, so a client disconnect still cancels the query
+	queryCtx, cancel := context.WithTimeout(ctx, historyQueryTimeout)
+	defer cancel()
+	data, err := store.GetAll(queryCtx, filter, 1, 100)
+	if err != nil {
+		logger.Error("error retrieving all sensor data", zap.Duration("timeout", historyQueryTimeout), zap.Error(err))
+		return err
+	}
+	// send the history in chunks so a slow client isn't stuck on one huge
+	// frame; "more" tells the client whether further chunks follow
+	for start := 0; start == 0 || start < len(data); start += historyChunkSize {
+		end := start + historyChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := client.writeJSON(gin.H{"message": "successfully retrieved sensor data", "data": data[start:end], "more": end < len(data)}); err != nil {
+			logger.Error("error sending sensor data history", zap.Bool("permanent", isPermanentWSWriteError(err)), zap.Error(err))
+			if !isPermanentWSWriteError(err) {
+				return err
+			}
+			// drop the client now rather than when the read loop notices;
+			// closing the socket is what makes that loop exit
+			removeClients(client)
+			client.conn.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// broadcast sends a newly stored reading to interested websocket clients.
+// data must already carry its inserted id; it is sent as-is rather than
+// being read back from Mongo.
+func broadcast(data *SensorData) {
+	message := gin.H{"message": "new sensor data", "data": data}
+	if broadcastIngestLag {
+		message["ingest_lag_ms"] = time.Since(data.Timestamp).Milliseconds()
+	}
+	broadcastMessage(message, func(client *wsClient) bool { return client.wants(data) })
+}
+
+// broadcastMessage writes message to every connected client accepted by
+// match (all of them when match is nil), at most broadcastConcurrency at a
+// time, so one slow client only delays its own write. message is encoded
+// once up front; if that fails nobody is sent anything and nobody is
+// dropped. Clients whose write then fails are closed and pruned from
+// clients so later broadcasts don't keep retrying a dead socket.
+func broadcastMessage(message interface{}, match func(*wsClient) bool) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("error encoding websocket broadcast", zap.Error(err))
+		return
+	}
+	lock.Lock()
+	targets := make([]*wsClient, 0, len(clients))
+	for _, client := range clients {
+		if match == nil || match(client) {
+			targets = append(targets, client)
+		}
+	}
+	lock.Unlock()
+
+	sem := make(chan struct{}, broadcastConcurrency)
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failed []*wsClient
+	for _, client := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(client *wsClient) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// payload is already encoded, so any error is the connection's
+			if err := client.writeMessage(websocket.TextMessage, payload); err != nil {
+				logger.Error("error broadcasting to websocket client", zap.Error(err))
+				client.conn.Close()
+				failedMu.Lock()
+				failed = append(failed, client)
+				failedMu.Unlock()
+			}
+		}(client)
+	}
+	wg.Wait()
+	removeClients(failed...)
+}
+
+// goingAwayReason is the close-frame reason sent when the server shuts
+// down. It is JSON so clients can read reconnect_after_ms, a per-client
+// delay between wsReconnectBase and twice that, which spreads reconnects
+// out instead of every client arriving at once after a deploy.
+func goingAwayReason() string {
+	delay := wsReconnectBase + time.Duration(rand.Int63n(int64(wsReconnectBase)))
+	reason, _ := json.Marshal(gin.H{"reason": "server shutting down", "reconnect_after_ms": delay.Milliseconds()})
+	return string(reason)
+}
+
+// closeAllClients sends a going-away close frame to every websocket client
+// and closes it. http.Server.Shutdown doesn't track hijacked connections, so
+// without this clients would hang until their TCP connection times out. main
+// calls it once Shutdown has returned.
+func closeAllClients() {
+	lock.Lock()
+	targets := make([]*wsClient, len(clients))
+	copy(targets, clients)
+	lock.Unlock()
+
+	for _, client := range targets {
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, goingAwayReason())
+		if err := client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+			logger.Error("error sending websocket close frame", zap.Error(err))
+		}
+		client.conn.Close()
+	}
+	logger.Info("websocket clients closed", zap.Int("count", len(targets)))
+}
+
+// watchPongs sets the initial read deadline and pushes it out on every
+// pong, so a client that stops answering pings within wsPongWait fails its
+// next read. gorilla only allows this from the reading goroutine, so it must
+// be called by the handler before the read loop starts.
+func watchPongs(client *wsClient) {
+	client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+}
+
+// keepAlive pings the client every wsPingInterval so idle connections aren't
+// dropped by load balancers. If a ping can't be written the connection is
+// closed, which ends the read loop and removes the client; a missing pong is
+// caught by the read deadline set in watchPongs.
+func keepAlive(ctx context.Context, client *wsClient) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				logger.Error("error sending websocket ping", zap.Error(err))
+				client.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// wsProtocolVersion is the control-message version this server speaks.
+const wsProtocolVersion = 1
+
+// wsEnvelope is a control message from a client, e.g.
+// {"v":1,"cmd":"subscribe","args":{"device_id":"..."}}. Envelopes and args
+// are decoded strictly: unknown fields, a missing or different version and
+// unknown commands all get a wsError reply, and the connection stays open.
+type wsEnvelope struct {
+	V    int             `json:"v"`
+	Cmd  string          `json:"cmd"`
+	Args json.RawMessage `json:"args"`
+}
+
+// wsError is the error half of a reply to a control message; Code is stable
+// for clients to switch on, Message is for people.
+type wsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newWSError(code, format string, args ...interface{}) *wsError {
+	return &wsError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// wsCommandHandler applies one command's args, decoded with decodeWSArgs,
+// and returns the fields of its reply.
+type wsCommandHandler func(client *wsClient, args json.RawMessage) (gin.H, *wsError)
+
+// wsCommands lists the control commands; adding one is adding a handler
+// here.
+var wsCommands = map[string]wsCommandHandler{
+	// subscribe limits the client to one device: {"device_id":"..."}
+	"subscribe": func(client *wsClient, raw json.RawMessage) (gin.H, *wsError) {
+		var args struct {
+			DeviceID string `json:"device_id"`
+		}
+		if err := decodeWSArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if !deviceIdPattern.MatchString(args.DeviceID) {
+			return nil, newWSError("invalid_args", "invalid device id")
+		}
+		client.setDevice(args.DeviceID)
+		return gin.H{"message": "subscribed", "device_id": args.DeviceID}, nil
+	},
+	// unsubscribe goes back to every device; it takes no args
+	"unsubscribe": func(client *wsClient, raw json.RawMessage) (gin.H, *wsError) {
+		if err := decodeWSArgs(raw, &struct{}{}); err != nil {
+			return nil, err
+		}
+		client.setDevice("")
+		return gin.H{"message": "unsubscribed"}, nil
+	},
+}
+
+// decodeStrictJSON decodes exactly one JSON value from data into v,
+// refusing unknown fields and trailing data.
+func decodeStrictJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// decodeWSArgs decodes a command's args into v; missing args decode as {}.
+func decodeWSArgs(raw json.RawMessage, v interface{}) *wsError {
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = json.RawMessage("{}")
+	}
+	if err := decodeStrictJSON(raw, v); err != nil {
+		return newWSError("invalid_args", "invalid args: %v", err)
+	}
+	return nil
+}
+
+// handleCommand applies a client's control message and returns the reply
+// to send, which echoes v and cmd and carries either the command's result
+// or an error.
+func handleCommand(client *wsClient, message []byte) gin.H {
+	reply := gin.H{"v": wsProtocolVersion}
+	var env wsEnvelope
+	if err := decodeStrictJSON(message, &env); err != nil {
+		reply["error"] = newWSError("invalid_message", "invalid control message: %v", err)
+		return reply
+	}
+	if env.Cmd != "" {
+		reply["cmd"] = env.Cmd
+	}
+	if env.V != wsProtocolVersion {
+		reply["error"] = newWSError("unsupported_version", "unsupported version %d, want %d", env.V, wsProtocolVersion)
+		return reply
+	}
+	handler, ok := wsCommands[env.Cmd]
+	if !ok {
+		reply["error"] = newWSError("unknown_command", "unknown command %q", env.Cmd)
+		return reply
+	}
+	result, wsErr := handler(client, env.Args)
+	if wsErr != nil {
+		reply["error"] = wsErr
+		return reply
+	}
+	for k, v := range result {
+		reply[k] = v
+	}
+	return reply
+}
+
+// heartbeat broadcasts the server time to every websocket client each
+// interval until ctx is done, so dashboards can tell a quiet sensor fleet
+// from a dead server.
+func heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			broadcastMessage(gin.H{"message": "heartbeat", "serverTime": now.UTC().Format(time.RFC3339)}, nil)
+		}
+	}
+}
+
+func removeClients(toRemove ...*wsClient) {
+	if len(toRemove) == 0 {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, client := range toRemove {
+		for i, c := range clients {
+			if c == client {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+	}
+	websocketClients.Set(float64(len(clients)))
+}
+
+func newSensorData(payload SensorDataPayload) *SensorData {
+	return &SensorData{
+		DeviceID:       payload.DeviceID,
+		Temperature:    *payload.Temperature,
+		Humidity:       *payload.Humidity,
+		Timestamp:      time.Now().UTC(),
+		Quality:        payload.Quality,
+		SuspectedFault: payload.SuspectedFault,
+		Seq:            payload.Seq,
+	}
+}
+
+// publishSensorData fans a freshly stored reading out to metrics, the NDJSON
+// stream, the alert webhook and websocket clients.
+func publishSensorData(data *SensorData) {
+	// readings are timestamped by the server on arrival, so the lag here is
+	// our own processing delay and normally close to zero
+	ingestLag.Observe(time.Since(data.Timestamp).Seconds())
+	readingsEmitter.emit(data)
+	raiseAlerts(data)
+	broadcast(data)
+}
+
+// deviceTail returns a device's last n readings, oldest first, the way tail
+// prints the end of a file before following it.
+func deviceTail(ctx context.Context, store SensorStore, deviceId string, n int) ([]*SensorData, error) {
+	data, _, err := store.DeviceHistory(ctx, deviceId, 1, n)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return data, nil
+}
+
+// closeWebsocket sends a close frame with code and reason before closing, so
+// the client sees why it was disconnected instead of a dropped connection.
+func closeWebsocket(ws *websocket.Conn, code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(wsWriteWait)); err != nil {
+		logger.Error("error sending websocket close frame", zap.Error(err))
+	}
+	ws.Close()
+}
+
+func sendSensorData(ctx context.Context, store SensorStore, payload SensorDataPayload) (*SensorData, error) {
+	data := newSensorData(payload)
+	if err := prepareSensorData(ctx, data); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	insertedId, err := store.Add(ctx, data)
+	sensorInsertDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		sensorInsertFailures.Inc()
+		deadLetters.record(err, data)
+		return nil, err
+	}
+	sensorInserts.Inc()
+	data.Id = insertedId
+	publishSensorData(data)
+	return data, nil
+}
+
+// batchError points at the reading that stopped a batch from being stored.
+type batchError struct {
+	Index int
+	Err   error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("reading %d: %v", e.Index, e.Err)
+}
+
+func (e *batchError) Unwrap() error {
+	return e.Err
+}
+
+// sendSensorDataBatch stores all readings with one InsertMany and publishes
+// each of them once the whole batch is stored. Nothing is stored if any
+// reading fails prepareSensorData; the error is then a *batchError.
+func sendSensorDataBatch(ctx context.Context, store SensorStore, payloads []SensorDataPayload) ([]primitive.ObjectID, error) {
+	data := make([]*SensorData, len(payloads))
+	for i, payload := range payloads {
+		data[i] = newSensorData(payload)
+		if err := prepareSensorData(ctx, data[i]); err != nil {
+			return nil, &batchError{Index: i, Err: err}
+		}
+	}
+	start := time.Now()
+	insertedIds, err := store.AddBatch(ctx, data)
+	sensorInsertDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		sensorInsertFailures.Add(float64(len(data)))
+		// the insert is ordered, so readings before the first write error
+		// were stored; only the rest are dead-lettered
+		unstored := data
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+			unstored = data[bulkErr.WriteErrors[0].Index:]
+		}
+		deadLetters.record(err, unstored...)
+		return nil, err
+	}
+	sensorInserts.Add(float64(len(data)))
+	for _, d := range data {
+		publishSensorData(d)
+	}
+	return insertedIds, nil
+}
+
+// connectMongo connects and pings MongoDB within timeout. The context is
+// scoped to these two calls only; the driver manages its own connections
+// afterwards.
+func connectMongo(clientOpts *options.ClientOptions, timeout time.Duration) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
+	return client, nil
+}
+
+// mongoClientOptions builds the client options from DB_URI, or, when that is
+// unset, from DB_HOST and DB_PORT (default 27017) with optional DB_USER and
+// DB_PASSWORD credentials authenticated against DB_AUTH_SOURCE (default
+// admin). Keeping the password out of the URI lets it come from a secrets
+// manager on its own; only the host is ever logged.
+func mongoClientOptions() *options.ClientOptions {
+	if uri := os.Getenv("DB_URI"); uri != "" {
+		logger.Info("using mongodb connection string from $DB_URI")
+		return options.Client().ApplyURI(uri)
+	}
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		logger.Fatal("$DB_URI or $DB_HOST must be set")
+	}
+	addr := net.JoinHostPort(host, getEnvString("DB_PORT", "27017"))
+	clientOpts := options.Client().SetHosts([]string{addr})
+	user := os.Getenv("DB_USER")
+	if user != "" {
+		clientOpts.SetAuth(options.Credential{
+			Username:   user,
+			Password:   os.Getenv("DB_PASSWORD"),
+			AuthSource: getEnvString("DB_AUTH_SOURCE", "admin"),
+		})
+	}
+	logger.Info("using mongodb host", zap.String("host", addr), zap.Bool("authenticated", user != ""))
+	return clientOpts
+}
+
+// configureMongoPool applies DB_MAX_POOL_SIZE, DB_MIN_POOL_SIZE and
+// DB_MAX_CONN_IDLE_TIME to clientOpts. Unset values keep the driver
+// defaults (100, 0 and no idle limit).
+func configureMongoPool(clientOpts *options.ClientOptions) {
+	maxPoolSize := getEnvInt("DB_MAX_POOL_SIZE", 100)
+	minPoolSize := getEnvInt("DB_MIN_POOL_SIZE", 0)
+	maxConnIdleTime := getEnvDuration("DB_MAX_CONN_IDLE_TIME", 0)
+	if maxPoolSize < 0 || minPoolSize < 0 || maxConnIdleTime < 0 {
+		logger.Fatal("$DB_MAX_POOL_SIZE, $DB_MIN_POOL_SIZE and $DB_MAX_CONN_IDLE_TIME must not be negative")
+	}
+	// a max of 0 means unlimited to the driver
+	if maxPoolSize != 0 && minPoolSize > maxPoolSize {
+		logger.Fatal("$DB_MIN_POOL_SIZE must not exceed $DB_MAX_POOL_SIZE")
+	}
+	clientOpts.SetMaxPoolSize(uint64(maxPoolSize)).
+		SetMinPoolSize(uint64(minPoolSize)).
+		SetMaxConnIdleTime(maxConnIdleTime)
+	logger.Info("mongodb connection pool configured",
+		zap.Int("max_pool_size", maxPoolSize),
+		zap.Int("min_pool_size", minPoolSize),
+		zap.Duration("max_conn_idle_time", maxConnIdleTime))
+}
+
+// configureMongoConsistency applies DB_WRITE_CONCERN ("majority" or a
+// number of nodes), DB_WRITE_JOURNAL and DB_READ_PREFERENCE (primary,
+// primaryPreferred, secondary, secondaryPreferred or nearest) to
+// clientOpts. Writes always go to the primary, so a secondary read
+// preference only moves the query, stats and aggregation endpoints off it,
+// at the cost of possibly reading slightly stale data. Unset values keep
+// the server or URI defaults.
+func configureMongoConsistency(clientOpts *options.ClientOptions) {
+	w := os.Getenv("DB_WRITE_CONCERN")
+	_, journalSet := os.LookupEnv("DB_WRITE_JOURNAL")
+	if w != "" || journalSet {
+		wc := &writeconcern.WriteConcern{}
+		if w == "majority" {
+			wc.W = "majority"
+		} else if w != "" {
+			nodes, err := strconv.Atoi(w)
+			if err != nil || nodes < 0 {
+				logger.Fatal("$DB_WRITE_CONCERN must be \"majority\" or a non-negative number", zap.String("value", w))
+			}
+			wc.W = nodes
+		}
+		if journalSet {
+			journal := getEnvBool("DB_WRITE_JOURNAL", false)
+			wc.Journal = &journal
+		}
+		clientOpts.SetWriteConcern(wc)
+	}
+
+	mode := getEnvString("DB_READ_PREFERENCE", "")
+	if mode != "" {
+		readMode, err := readpref.ModeFromString(mode)
+		if err != nil {
+			logger.Fatal("invalid value for DB_READ_PREFERENCE", zap.String("value", mode), zap.Error(err))
+		}
+		rp, err := readpref.New(readMode)
+		if err != nil {
+			logger.Fatal("invalid value for DB_READ_PREFERENCE", zap.String("value", mode), zap.Error(err))
+		}
+		clientOpts.SetReadPreference(rp)
+	}
+	logger.Info("mongodb consistency configured",
+		zap.String("write_concern", getEnvString("DB_WRITE_CONCERN", "default")),
+		zap.String("write_journal", getEnvString("DB_WRITE_JOURNAL", "default")),
+		zap.String("read_preference", getEnvString("DB_READ_PREFERENCE", "default")))
+}
+
+// connectMongoWithRetry calls connectMongo up to attempts times, doubling
+// the wait between attempts from backoff, so the service survives starting
+// before MongoDB does. It gives up early once maxWait has passed.
+func connectMongoWithRetry(clientOpts *options.ClientOptions, timeout time.Duration, attempts int, backoff, maxWait time.Duration) (*mongo.Client, error) {
+	deadline := time.Now().Add(maxWait)
+	for attempt := 1; ; attempt++ {
+		client, err := connectMongo(clientOpts, timeout)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= attempts || time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		logger.Warn("mongodb connection failed, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// listenAddr resolves the server address from LISTEN_ADDR (host:port), or
+// PORT (port only), defaulting to :8000.
+func listenAddr() string {
+	addr := ":8000"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	if listen := os.Getenv("LISTEN_ADDR"); listen != "" {
+		addr = listen
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		logger.Fatal("invalid listen address, expected host:port such as :8000 or 127.0.0.1:8000", zap.String("addr", addr), zap.Error(err))
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		logger.Fatal("invalid listen port, expected a number between 0 and 65535", zap.String("addr", addr))
+	}
+	return addr
+}
+
+// ensureIndexes creates the indexes the read paths rely on, plus a TTL index
+// on timestamp when retentionDays > 0. CreateMany is a no-op for indexes that
+// already exist with the same spec, so this is safe to run on every startup.
+func ensureIndexes(ctx context.Context, mc *mongo.Collection, retentionDays int) error {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "timestamp", Value: -1}}},
+	}
+	names, err := mc.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return err
+	}
+	logger.Info("indexes ensured", zap.Strings("indexes", names))
+	if retentionDays > 0 {
+		return ensureTTLIndex(ctx, mc, int32(retentionDays*24*60*60))
+	}
+	return nil
+}
+
+const ttlIndexName = "timestamp_ttl"
+
+// ensureTTLIndex expires readings expireAfterSeconds after their timestamp.
+// Mongo rejects re-creating an index with a different expireAfterSeconds, so
+// when the retention changes the existing index is updated in place with
+// collMod instead of being dropped and rebuilt.
+func ensureTTLIndex(ctx context.Context, mc *mongo.Collection, expireAfterSeconds int32) error {
+	cursor, err := mc.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var indexes []bson.M
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index["name"] != ttlIndexName {
+			continue
+		}
+		// the server may report the value as any numeric BSON type
+		var current int64 = -1
+		switch v := index["expireAfterSeconds"].(type) {
+		case int32:
+			current = int64(v)
+		case int64:
+			current = v
+		case float64:
+			current = int64(v)
+		}
+		if current == int64(expireAfterSeconds) {
+			return nil
+		}
+		cmd := bson.D{
+			{Key: "collMod", Value: mc.Name()},
+			{Key: "index", Value: bson.M{"name": ttlIndexName, "expireAfterSeconds": expireAfterSeconds}},
+		}
+		if err := mc.Database().RunCommand(ctx, cmd).Err(); err != nil {
+			return err
+		}
+		logger.Info("ttl index updated", zap.Int32("expire_after_seconds", expireAfterSeconds))
+		return nil
+	}
+
+	_, err = mc.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetName(ttlIndexName).SetExpireAfterSeconds(expireAfterSeconds),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("ttl index created", zap.Int32("expire_after_seconds", expireAfterSeconds))
+	return nil
+}
+
+// ensureCappedCollection creates name as a capped collection of sizeBytes
+// (and at most maxDocs documents when maxDocs > 0) unless it already exists.
+// An existing non-capped collection is left alone with a warning, since
+// converting it would rewrite all of its data.
+func ensureCappedCollection(ctx context.Context, db *mongo.Database, name string, sizeBytes, maxDocs int64) error {
+	specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": name})
+	if err != nil {
+		return err
+	}
+	if len(specs) > 0 {
+		capped, _ := specs[0].Options.Lookup("capped").BooleanOK()
+		if !capped {
+			logger.Warn("collection already exists and is not capped; CAPPED_COLLECTION_SIZE ignored", zap.String("collection", name))
+		}
+		return nil
+	}
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(sizeBytes)
+	if maxDocs > 0 {
+		opts.SetMaxDocuments(maxDocs)
+	}
+	if err := db.CreateCollection(ctx, name, opts); err != nil {
+		return err
+	}
+	logger.Info("capped collection created", zap.String("collection", name), zap.Int64("size_bytes", sizeBytes), zap.Int64("max_docs", maxDocs))
+	return nil
+}
+
+// statusPage is a small operational dashboard that polls /health, /ready
+// and /metrics from the browser.
+//
+//go:embed status.html
+var statusPage []byte
+
+// prettyJSON indents every JSON response; enable it with PRETTY_JSON in
+// development. Clients can also opt in per request with ?pretty=true.
+var prettyJSON bool
+
+func respondJSON(c *gin.Context, code int, obj interface{}) {
+	// error bodies carry the request id so a failure a client reports can be
+	// found in the logs
+	if body, ok := obj.(gin.H); ok && code >= http.StatusBadRequest && body["error"] != nil {
+		if id := c.GetString("request_id"); id != "" {
+			body["request_id"] = id
+		}
+	}
+	if prettyJSON || c.Query("pretty") == "true" {
+		c.Render(code, render.IndentedJSON{Data: obj})
+		return
+	}
+	c.Render(code, render.JSON{Data: obj})
+}
+
+// readingDeviceIds returns the device id of each reading.
+func readingDeviceIds(data []*SensorData) []string {
+	ids := make([]string, len(data))
+	for i, d := range data {
+		ids[i] = d.DeviceID
+	}
+	return ids
+}
+
+// maxResponseBytes is a soft cap on the encoded readings of a listing or
+// batch-get response (MAX_RESPONSE_BYTES, default 4MiB, 0 for none). Past it
+// the readings are cut short, truncated is set and a cursor says where to
+// carry on.
+var maxResponseBytes = 4 << 20
+
+// fitResponse returns how many leading readings of data fit within
+// maxResponseBytes once encoded, len(data) when they all do. The first
+// reading is always kept so a client following the cursor makes progress.
+func fitResponse(data []*SensorData) int {
+	if maxResponseBytes <= 0 {
+		return len(data)
+	}
+	size := 0
+	for i, d := range data {
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			return len(data)
+		}
+		if size += len(encoded) + 1; size > maxResponseBytes && i > 0 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+func abortWithJSON(c *gin.Context, code int, obj interface{}) {
+	c.Abort()
+	respondJSON(c, code, obj)
+}
+
+func requireReady(c *gin.Context) {
+	if !ready.Load() {
+		abortWithJSON(c, http.StatusServiceUnavailable, gin.H{"error": "service is starting"})
+		return
+	}
+	c.Next()
+}
+
+func main() {
+	defer logger.Sync()
+	if err := godotenv.Load(".env"); err != nil {
+		logger.Fatal("Error loading .env file")
+	}
+	// .env may set LOG_LEVEL/LOG_FORMAT, so the logger is rebuilt once it
+	// has been loaded
+	logger = newLogger()
+	logger.Info("starting", zap.String("version", version), zap.String("commit", commit), zap.String("build_time", buildTime))
+
+	mongoOpts := mongoClientOptions()
+	configureMongoPool(mongoOpts)
+	configureMongoConsistency(mongoOpts)
+	dbName := getEnvNonEmpty("DB_NAME", "sensor-project")
+	collectionName := getEnvNonEmpty("DB_COLLECTION", "sensor-data")
+	logger.Info("using mongodb database", zap.String("database", dbName), zap.String("collection", collectionName))
+	registerHTTPMetrics()
+	if seqMax = int64(getEnvInt("SEQ_MAX", int(seqMax))); seqMax <= 0 {
+		logger.Fatal("$SEQ_MAX must be positive")
+	}
+	prettyJSON = getEnvBool("PRETTY_JSON", false)
+	maxResponseBytes = getEnvInt("MAX_RESPONSE_BYTES", maxResponseBytes)
+	configureFaultDetection()
+	configureRuntime()
+	configureAlerts()
+	broadcastIngestLag = getEnvBool("BROADCAST_INGEST_LAG", false)
+	wsPingInterval = getEnvDuration("WS_PING_INTERVAL", wsPingInterval)
+	wsPongWait = getEnvDuration("WS_PONG_WAIT", wsPongWait)
+	if wsPingInterval <= 0 || wsPongWait <= wsPingInterval {
+		logger.Fatal("$WS_PING_INTERVAL must be positive and less than $WS_PONG_WAIT")
+	}
+	websocketUpgrader.ReadBufferSize = getEnvInt("WS_READ_BUFFER_SIZE", websocketUpgrader.ReadBufferSize)
+	websocketUpgrader.WriteBufferSize = getEnvInt("WS_WRITE_BUFFER_SIZE", websocketUpgrader.WriteBufferSize)
+	wsWriteWait = getEnvDuration("WS_WRITE_TIMEOUT", wsWriteWait)
+	wsReadLimit = int64(getEnvInt("WS_READ_LIMIT", int(wsReadLimit)))
+	if wsWriteWait <= 0 || wsReadLimit <= 0 {
+		logger.Fatal("$WS_WRITE_TIMEOUT and $WS_READ_LIMIT must be positive")
+	}
+	if wsReconnectBase = getEnvDuration("WS_RECONNECT_BASE", wsReconnectBase); wsReconnectBase < time.Millisecond {
+		logger.Fatal("$WS_RECONNECT_BASE must be at least 1ms")
+	}
+	if broadcastConcurrency = getEnvInt("BROADCAST_CONCURRENCY", broadcastConcurrency); broadcastConcurrency <= 0 {
+		logger.Fatal("$BROADCAST_CONCURRENCY must be positive")
+	}
+	stepdownRetries = getEnvInt("INSERT_STEPDOWN_RETRIES", stepdownRetries)
+	stepdownBackoff = getEnvDuration("INSERT_STEPDOWN_BACKOFF", stepdownBackoff)
+	if historyChunkSize = getEnvInt("WS_HISTORY_CHUNK_SIZE", historyChunkSize); historyChunkSize <= 0 {
+		logger.Fatal("$WS_HISTORY_CHUNK_SIZE must be positive")
+	}
+	historyQueryTimeout = getEnvDuration("WS_HISTORY_TIMEOUT", historyQueryTimeout)
+	// EXPORT_DRAIN_TIMEOUT is how long shutdown lets running exports finish;
+	// it sits inside the 5s shutdown deadline so MongoDB is still connected
+	// while they do
+	exportDrainTimeout := getEnvDuration("EXPORT_DRAIN_TIMEOUT", 4*time.Second)
+	outboundClient = newOutboundClient()
+	// MongoDB refuses TTL indexes on capped collections, so retention has to
+	// come from one or the other; catch that here rather than after connecting
+	cappedSize := getEnvInt("CAPPED_COLLECTION_SIZE", 0)
+	cappedMaxDocs := getEnvInt("CAPPED_COLLECTION_MAX_DOCS", 0)
+	retentionDays := getEnvInt("DATA_RETENTION_DAYS", 0)
+	if cappedSize > 0 && retentionDays > 0 {
+		logger.Fatal("$CAPPED_COLLECTION_SIZE and $DATA_RETENTION_DAYS can't both be set: capped collections don't support TTL indexes")
+	}
+
+	startedAt := time.Now()
+	var dbClient *mongo.Client
+	var sensorCollection *mongo.Collection
+	var sensorStore SensorStore
+	var deviceCollection *mongo.Collection
+
+	if getEnvBool("EMIT_STDOUT_NDJSON", false) {
+		// stdout carries only readings; move gin's own output out of the way
+		gin.DefaultWriter = os.Stderr
+		readingsEmitter = newNDJSONEmitter(os.Stdout)
+	}
+
+	r := gin.New()
+	// ClientIP drives rate limiting and logging, so forwarding headers are
+	// only believed from proxies listed in TRUSTED_PROXIES (comma-separated
+	// IPs or CIDRs); by default the connection's address is used as-is
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		logger.Fatal("invalid value for TRUSTED_PROXIES", zap.Error(err))
+	}
+	r.Use(requestID(), requestLogger(), recoveryMiddleware())
+	r.LoadHTMLFiles("./data.html")
+	r.Use(metricsMiddleware())
+	r.Use(corsMiddleware())
+	r.Use(limitRequestBody())
+	r.Use(requestTimeout())
+	r.Use(func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.Next()
+	})
+	r.NoRoute(func(ctx *gin.Context) {
+		loggerFor(ctx).Error("endpoint not found", zap.String("path", ctx.Request.URL.Path))
+		respondJSON(ctx, 404, gin.H{"error": "endpoint not found"})
+	})
+	// write routes require X-API-Key; reads, probes and metrics stay public
+	apiKeyAuth := requireAPIKey()
+	deviceRateLimit := newDeviceRateLimiter()
+	ipRateLimit := rateLimitByIP()
+
+	r.GET("/", func(c *gin.Context) {
+		loggerFor(c).Info("welcome to iot sensor project api", zap.String("status", "ok"))
+		respondJSON(c, http.StatusOK, gin.H{"data": "welcome to iot sensor project api"})
+	})
+	// /health is liveness: it only says the process is up. /ready is
+	// readiness and also checks that MongoDB answers a ping.
+	r.GET("/health", func(ctx *gin.Context) {
+		loggerFor(ctx).Info("health check", zap.String("status", "ok"))
+		respondJSON(ctx, http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	r.GET("/version", func(c *gin.Context) {
+		respondJSON(c, http.StatusOK, gin.H{"version": version, "commit": commit, "build_time": buildTime})
+	})
+
+	readyPingTimeout := getEnvDuration("READY_PING_TIMEOUT", 2*time.Second)
+	r.GET("/ready", func(c *gin.Context) {
+		if !ready.Load() {
+			respondJSON(c, http.StatusServiceUnavailable, gin.H{"status": "starting"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readyPingTimeout)
+		defer cancel()
+		if err := dbClient.Ping(ctx, nil); err != nil {
+			loggerFor(c).Error("readiness check failed", zap.Error(err))
+			respondJSON(c, http.StatusServiceUnavailable, gin.H{"status": "degraded", "db": "unreachable"})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"status": "ready", "db": "ok"})
+	})
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// INSERT_RETURNS_CREATED switches POST /sensor to 201 with a Location
+	// header, and POST /sensor/batch to 201 without one. The backfill
+	// endpoint keeps 200 since it reports per-record results.
+	createdOnInsert := getEnvBool("INSERT_RETURNS_CREATED", false)
+	r.POST("/sensor", ipRateLimit, apiKeyAuth, requireJSON, requireReady, func(c *gin.Context) {
+		var payload SensorDataPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if err := validatePayload(payload); err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !deviceRateLimit.allow(c, payload.DeviceID) {
+			return
+		}
+		if !screenSensorFault(c, &payload, nil) {
+			return
+		}
+		responseChan := make(chan SensorDataResponse, 1) //1 will prevent blocking
+
+		ctx := c.Request.Context()
+		if !enqueueSensorData(SensorDataRequest{Payload: payload, Ctx: ctx, ResponseChan: responseChan}) {
+			respondJSON(c, http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+			return
+		}
+		select {
+		case response := <-responseChan:
+			if errors.Is(response.Err, context.DeadlineExceeded) {
+				// the insert itself ran out of REQUEST_TIMEOUT before ctx.Done
+				// was selected; report it the same way
+				loggerFor(c).Error("timeout or context cancelled", zap.Error(response.Err))
+				respondJSON(c, http.StatusRequestTimeout, gin.H{"error": "request timeout"})
+			} else if errors.As(response.Err, new(rangeError)) {
+				respondJSON(c, http.StatusBadRequest, gin.H{"error": response.Err.Error()})
+			} else if response.Err != nil {
+				loggerFor(c).Error("error sending sensor data", zap.Error(response.Err))
+				respondJSON(c, http.StatusInternalServerError, gin.H{"error": response.Err.Error()})
+			} else if response.InsertedId != nil {
+				loggerFor(c).Info("sensor data received", zap.String("inserted_id", primitive.ObjectID(*response.InsertedId).Hex()))
+				insertedId := primitive.ObjectID(*response.InsertedId).Hex()
+				// inserted_id is kept alongside the full document for older clients
+				body := gin.H{"message": "sensor data received", "inserted_id": insertedId, "data": response.Data}
+				if payload.SuspectedFault {
+					body["suspected_fault"] = true
+				}
+				status := http.StatusOK
+				if createdOnInsert {
+					status = http.StatusCreated
+					c.Header("Location", "/sensor/"+insertedId)
+				}
+				respondJSON(c, status, body)
+			}
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				loggerFor(c).Error("timeout or context cancelled", zap.Error(ctx.Err()))
+				respondJSON(c, http.StatusRequestTimeout, gin.H{"error": "request timeout"})
+				return
+			}
+			respondJSON(c, http.StatusRequestTimeout, gin.H{"error": "request cancelled by client"})
+			return
+		}
+	})
+	maxQueryLimit := getEnvInt("QUERY_MAX_LIMIT", 1000)
+	r.GET("/sensor", requireReady, func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		minQuality, err := parseMinQuality(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		limit := 100
+		if raw := c.Query("limit"); raw != "" {
+			if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+				respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q", raw)})
+				return
+			}
+		}
+		if limit > maxQueryLimit {
+			limit = maxQueryLimit
+		}
+		// without from/to this matches getAllSensorData: the first 100 readings
+		data, err := sensorStore.Query(c.Request.Context(), SensorFilter{From: from, To: to, MinQuality: minQuality}, limit)
+		if err != nil {
+			loggerFor(c).Error("error querying sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		body := gin.H{"message": "successfully retrieved sensor data"}
+		// a response cut short by MAX_RESPONSE_BYTES continues from the first
+		// reading left out; readings sharing its timestamp may come again
+		if n := fitResponse(data); n < len(data) {
+			body["truncated"] = true
+			body["next_from"] = data[n].Timestamp.UTC().Format(time.RFC3339Nano)
+			data = data[:n]
+		}
+		body["data"] = data
+		respondJSON(c, http.StatusOK, body)
+	})
+
+	r.GET("/sensor/count", requireReady, func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		deviceId, err := parseDeviceIdQuery(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		count, err := sensorStore.Count(c.Request.Context(), SensorFilter{DeviceID: deviceId, From: from, To: to})
+		if err != nil {
+			loggerFor(c).Error("error counting sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"count": count})
+	})
+	maxPageSize := getEnvInt("PAGE_MAX_SIZE", 1000)
+	r.GET("/sensor/all", requireReady, func(c *gin.Context) {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "page must be a positive integer"})
+			return
+		}
+		size, err := strconv.Atoi(c.DefaultQuery("size", "100"))
+		if err != nil || size < 1 || size > maxPageSize {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between 1 and %d", maxPageSize)})
+			return
+		}
+		minQuality, err := parseMinQuality(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter := SensorFilter{MinQuality: minQuality}
+		ctx := c.Request.Context()
+		total, err := sensorStore.Count(ctx, filter)
+		if err != nil {
+			loggerFor(c).Error("error counting sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := sensorStore.GetAll(ctx, filter, page, size)
+		if err != nil {
+			loggerFor(c).Error("error retrieving all sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"message": "successfully retrieved sensor data", "data": data, "page": page, "size": size, "total": total})
+	})
+	// a device with no readings is not an error: it gets an empty page with
+	// a total of 0, the same as a page past the end
+	r.GET("/sensor/device/:deviceId", requireReady, func(c *gin.Context) {
+		deviceId := c.Param("deviceId")
+		if !deviceIdPattern.MatchString(deviceId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "invalid device id"})
+			return
+		}
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "page must be a positive integer"})
+			return
+		}
+		size, err := strconv.Atoi(c.DefaultQuery("size", "100"))
+		if err != nil || size < 1 || size > maxPageSize {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between 1 and %d", maxPageSize)})
+			return
+		}
+		data, total, err := sensorStore.DeviceHistory(c.Request.Context(), deviceId, page, size)
+		if err != nil {
+			loggerFor(c).Error("error retrieving device sensor data", zap.String("device_id", deviceId), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"message": "successfully retrieved sensor data", "device_id": deviceId, "data": data, "page": page, "size": size, "total": total})
+	})
+	r.GET("/sensor/export.csv", requireReady, func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx, done, ok := trackExport(c.Request.Context())
+		if !ok {
+			respondJSON(c, http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+			return
+		}
+		defer done()
+		if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+			loggerFor(c).Warn("could not lift write deadline for export", zap.Error(err))
+		}
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="sensor-data.csv"`)
+		// X-Export-Status arrives as a trailer once the body is written:
+		// "complete", or "truncated" alongside a final "# truncated" line
+		c.Header("Trailer", "X-Export-Status")
+		c.Status(http.StatusOK)
+		rows, err := sensorStore.ExportCSV(ctx, SensorFilter{From: from, To: to}, c.Writer, c.Writer.Flush)
+		if err != nil {
+			// the status line is already sent, so the best left is to mark
+			// the file as cut short
+			reason := "export failed"
+			if exportTruncatedByShutdown() {
+				reason = "server shutting down"
+			}
+			loggerFor(c).Error("error exporting sensor data", zap.Int("rows", rows), zap.String("reason", reason), zap.Error(err))
+			fmt.Fprintf(c.Writer, "# truncated: %s after %d rows\n", reason, rows)
+			c.Writer.Header().Set("X-Export-Status", "truncated")
+			return
+		}
+		c.Writer.Header().Set("X-Export-Status", "complete")
+		loggerFor(c).Info("sensor data exported", zap.Int("rows", rows))
+	})
+	r.GET("/sensor/:id", requireReady, func(c *gin.Context) {
+		id := c.Param("id")
+		data, err := sensorStore.Get(c.Request.Context(), id)
+		if errors.Is(err, errInvalidSensorDataId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			respondJSON(c, http.StatusNotFound, gin.H{"error": "sensor data not found"})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error retrieving sensor data", zap.String("id", id), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"data": data})
+	})
+
+	r.PUT("/sensor/:id", apiKeyAuth, requireReady, func(c *gin.Context) {
+		id := c.Param("id")
+		var payload SensorDataPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if err := validatePayload(payload); err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !screenSensorFault(c, &payload, nil) {
+			return
+		}
+		// corrections go through the same calibration as new readings
+		data := newSensorData(payload)
+		if err := prepareSensorData(c.Request.Context(), data); err != nil {
+			if errors.As(err, new(rangeError)) {
+				respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			loggerFor(c).Error("error preparing sensor data", zap.String("id", id), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := sensorStore.Update(c.Request.Context(), id, data)
+		if errors.Is(err, errInvalidSensorDataId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			respondJSON(c, http.StatusNotFound, gin.H{"error": "sensor data not found"})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error updating sensor data", zap.String("id", id), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		loggerFor(c).Info("sensor data updated", zap.String("id", id))
+		broadcastMessage(gin.H{"message": "sensor data updated", "data": data}, func(client *wsClient) bool { return client.wants(data) })
+		respondJSON(c, http.StatusOK, gin.H{"message": "sensor data updated", "data": data})
+	})
+
+	r.DELETE("/sensor/:id", apiKeyAuth, requireReady, func(c *gin.Context) {
+		id := c.Param("id")
+		deleted, err := sensorStore.Delete(c.Request.Context(), id)
+		if errors.Is(err, errInvalidSensorDataId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			respondJSON(c, http.StatusNotFound, gin.H{"error": "sensor data not found"})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error deleting sensor data", zap.String("id", id), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		loggerFor(c).Info("sensor data deleted", zap.String("id", id))
+		// only clients watching the reading's device hear about it
+		broadcastMessage(gin.H{"message": "sensor data deleted", "id": id, "device_id": deleted.DeviceID}, func(client *wsClient) bool { return client.wants(deleted) })
+		respondJSON(c, http.StatusOK, gin.H{"message": "sensor data deleted", "deleted_id": id})
+	})
+
+	r.GET("/devices/:id", requireReady, func(c *gin.Context) {
+		deviceId := c.Param("id")
+		if !deviceIdPattern.MatchString(deviceId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "invalid device id"})
+			return
+		}
+		device, err := getDevice(c.Request.Context(), deviceCollection, deviceId)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			respondJSON(c, http.StatusNotFound, gin.H{"error": "device not found"})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error retrieving device", zap.String("device_id", deviceId), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"data": device})
+	})
+	r.PUT("/devices/:id", apiKeyAuth, requireReady, func(c *gin.Context) {
+		deviceId := c.Param("id")
+		if !deviceIdPattern.MatchString(deviceId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "invalid device id"})
+			return
+		}
+		var payload DeviceMetadataPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		device, err := upsertDevice(c.Request.Context(), deviceCollection, deviceId, payload)
+		if err != nil {
+			loggerFor(c).Error("error updating device", zap.String("device_id", deviceId), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		calibrations.forget(deviceId)
+		loggerFor(c).Info("device metadata updated", zap.String("device_id", deviceId))
+		respondJSON(c, http.StatusOK, gin.H{"message": "device metadata updated", "data": device})
+	})
+
+	r.GET("/sensor/stats", requireReady, func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		minQuality, err := parseMinQuality(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		stats, err := sensorStore.Stats(c.Request.Context(), SensorFilter{From: from, To: to, MinQuality: minQuality})
+		if err != nil {
+			loggerFor(c).Error("error computing sensor stats", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"data": stats})
+	})
+
+	// GET /sensor/downsample leaves out buckets without readings unless
+	// fill=zero asks for a gapless series. A bucket too fine to cover the
+	// range in DOWNSAMPLE_MAX_BUCKETS buckets is coarsened to the smallest
+	// multiple of it that fits, rather than refused; the response's bucket
+	// is the size actually used, with requested_bucket alongside when it
+	// differs. An open range runs from the oldest reading to now.
+	maxDownsampleBuckets = getEnvInt("DOWNSAMPLE_MAX_BUCKETS", maxDownsampleBuckets)
+	if maxDownsampleBuckets <= 0 {
+		logger.Fatal("$DOWNSAMPLE_MAX_BUCKETS must be positive")
+	}
+	r.GET("/sensor/downsample", requireReady, func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		bucket, err := time.ParseDuration(c.DefaultQuery("bucket", "5m"))
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid bucket: %v", err)})
+			return
+		}
+		if _, _, err := bucketUnit(bucket); err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		fill := c.Query("fill")
+		if fill != "" && fill != "zero" {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid fill %q: only zero is supported", fill)})
+			return
+		}
+		// the series spans from to to, with an open end closed by now and
+		// an open start by the oldest reading
+		spanFrom, spanTo := from, to
+		if spanTo.IsZero() {
+			spanTo = time.Now().UTC()
+		}
+		if spanFrom.IsZero() {
+			oldest, err := sensorStore.Query(c.Request.Context(), SensorFilter{To: to}, 1)
+			if err != nil {
+				loggerFor(c).Error("error finding oldest reading", zap.Error(err))
+				respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			spanFrom = spanTo
+			if len(oldest) > 0 {
+				spanFrom = oldest[0].Timestamp
+			}
+		}
+		head := gin.H{"bucket": bucket.String()}
+		if coarse := coarsenBucket(spanFrom, spanTo, bucket, maxDownsampleBuckets); coarse != bucket {
+			head["bucket"] = coarse.String()
+			head["requested_bucket"] = bucket.String()
+			bucket = coarse
+		}
+		// buckets are streamed as the aggregation yields them; the status
+		// line only goes out with the first, so an early failure is still a
+		// 500 and a later one is flagged in the body
+		stream := &jsonArrayStream{c: c, head: head, field: "data"}
+		emit := func(b SensorBucket) error {
+			return stream.write(b)
+		}
+		var filler *bucketFiller
+		if fill == "zero" {
+			filler = newBucketFiller(spanFrom, bucket, emit)
+			emit = filler.add
+		}
+		err = sensorStore.Downsample(c.Request.Context(), SensorFilter{From: from, To: to}, bucket, emit)
+		if err == nil && filler != nil {
+			err = filler.finish(spanTo)
+		}
+		if err != nil && !stream.started {
+			loggerFor(c).Error("error downsampling sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error streaming downsampled sensor data", zap.Int("buckets", stream.n), zap.Error(err))
+			stream.finish(gin.H{"truncated": true, "error": err.Error()})
+			return
+		}
+		stream.finish(nil)
+	})
+
+	// GET /sensor/gaps reports sequence numbers a device sent that never
+	// arrived, judged from the seq of its stored readings in the range
+	maxGapSamples := getEnvInt("GAPS_MAX_SAMPLES", 100000)
+	r.GET("/sensor/gaps", requireReady, func(c *gin.Context) {
+		deviceId := c.Query("device_id")
+		if !deviceIdPattern.MatchString(deviceId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "a valid device_id is required"})
+			return
+		}
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		seqs, err := sensorStore.Sequences(c.Request.Context(), SensorFilter{DeviceID: deviceId, From: from, To: to}, maxGapSamples)
+		if err != nil {
+			loggerFor(c).Error("error retrieving sequence numbers", zap.String("device_id", deviceId), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		gaps := findSequenceGaps(seqs, seqMax)
+		var missing int64
+		for _, gap := range gaps {
+			missing += gap.Missing
+		}
+		respondJSON(c, http.StatusOK, gin.H{"device_id": deviceId, "readings": len(seqs), "missing": missing, "gaps": gaps})
+	})
+
+	r.GET("/sensor/latest", requireReady, func(c *gin.Context) {
+		data, err := sensorStore.Latest(c.Request.Context())
+		if err != nil {
+			loggerFor(c).Error("error retrieving latest sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		body := gin.H{}
+		// a response cut short by MAX_RESPONSE_BYTES lists the devices left
+		// out, to be fetched with POST /sensor/latest-batch
+		if n := fitResponse(data); n < len(data) {
+			body["truncated"] = true
+			body["remaining_device_ids"] = readingDeviceIds(data[n:])
+			data = data[:n]
+		}
+		body["data"] = data
+		respondJSON(c, http.StatusOK, body)
+	})
+
+	// POST /sensor/latest-batch takes a JSON array of device ids and returns
+	// each one's latest reading in one query, null for devices with none.
+	// LATEST_BATCH_MAX caps how many ids one request may name.
+	maxLatestBatch := getEnvInt("LATEST_BATCH_MAX", 100)
+	r.POST("/sensor/latest-batch", requireReady, func(c *gin.Context) {
+		var deviceIds []string
+		if err := c.ShouldBindJSON(&deviceIds); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if len(deviceIds) == 0 {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "no device ids provided"})
+			return
+		}
+		if len(deviceIds) > maxLatestBatch {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%d device ids exceeds maximum of %d", len(deviceIds), maxLatestBatch)})
+			return
+		}
+		latest := make(map[string]*SensorData, len(deviceIds))
+		for i, deviceId := range deviceIds {
+			if !deviceIdPattern.MatchString(deviceId) {
+				respondJSON(c, http.StatusBadRequest, gin.H{"error": "invalid device id", "index": i})
+				return
+			}
+			latest[deviceId] = nil
+		}
+		data, err := sensorStore.Latest(c.Request.Context(), deviceIds...)
+		if err != nil {
+			loggerFor(c).Error("error retrieving latest sensor data", zap.Int("devices", len(deviceIds)), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		body := gin.H{}
+		// as with GET /sensor/latest, devices cut by MAX_RESPONSE_BYTES are
+		// listed for a follow-up request
+		if n := fitResponse(data); n < len(data) {
+			remaining := readingDeviceIds(data[n:])
+			for _, deviceId := range remaining {
+				delete(latest, deviceId)
+			}
+			body["truncated"] = true
+			body["remaining_device_ids"] = remaining
+			data = data[:n]
+		}
+		for _, reading := range data {
+			latest[reading.DeviceID] = reading
+		}
+		body["data"] = latest
+		respondJSON(c, http.StatusOK, body)
+	})
+
+	maxPercentileSamples := getEnvInt("PERCENTILE_MAX_SAMPLES", 10000)
+	r.GET("/sensor/percentiles", requireReady, func(c *gin.Context) {
+		field := c.DefaultQuery("field", "temperature")
+		if !numericFields[field] {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported field %q", field)})
+			return
+		}
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		minQuality, err := parseMinQuality(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var ps []float64
+		for _, part := range strings.Split(c.DefaultQuery("p", "50,95,99"), ",") {
+			p, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || p < 0 || p > 100 {
+				respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid percentile %q: must be between 0 and 100", part)})
+				return
+			}
+			ps = append(ps, p)
+		}
+		count, percentiles, err := sensorStore.Percentiles(c.Request.Context(), field, SensorFilter{From: from, To: to, MinQuality: minQuality}, ps, maxPercentileSamples)
+		if err != nil {
+			loggerFor(c).Error("error computing percentiles", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"field": field, "count": count, "percentiles": percentiles})
+	})
+
+	maxRateSamples := getEnvInt("RATE_OF_CHANGE_MAX_SAMPLES", 10000)
+	r.GET("/sensor/rate-of-change", requireReady, func(c *gin.Context) {
+		field := c.DefaultQuery("field", "temperature")
+		if !numericFields[field] {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported field %q", field)})
+			return
+		}
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		minQuality, err := parseMinQuality(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// slopes are only meaningful between readings of the same sensor
+		deviceId := c.Query("device_id")
+		if deviceId == "" {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "device_id is required"})
+			return
+		}
+		if !deviceIdPattern.MatchString(deviceId) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "invalid device id"})
+			return
+		}
+		filter := SensorFilter{DeviceID: deviceId, From: from, To: to, MinQuality: minQuality}
+		rates, err := sensorStore.RateOfChange(c.Request.Context(), field, filter, maxRateSamples)
+		if errors.Is(err, errNotEnoughSamples) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error computing rate of change", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"device_id": deviceId, "field": field, "unit": "per_second", "data": rates})
+	})
+
+	// backfilled readings are historical, so they are stored without being
+	// broadcast to live websocket clients
+	maxBackfillBatch := getEnvInt("BACKFILL_MAX_BATCH", 1000)
+	r.POST("/sensor/backfill", apiKeyAuth, requireReady, func(c *gin.Context) {
+		var readings []BackfillReading
+		if err := c.ShouldBindJSON(&readings); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if len(readings) == 0 {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "no readings provided"})
+			return
+		}
+		if len(readings) > maxBackfillBatch {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("batch size %d exceeds maximum of %d", len(readings), maxBackfillBatch)})
+			return
+		}
+		results, err := sensorStore.Backfill(c.Request.Context(), readings)
+		if err != nil {
+			loggerFor(c).Error("error backfilling sensor data", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		failed := 0
+		for _, res := range results {
+			if res.Error != "" {
+				failed++
+			}
+		}
+		loggerFor(c).Info("sensor data backfilled", zap.Int("inserted", len(results)-failed), zap.Int("failed", failed))
+		respondJSON(c, http.StatusOK, gin.H{"message": "sensor data backfilled", "inserted": len(results) - failed, "failed": failed, "results": results})
+	})
+	maxBatchSize := getEnvInt("BATCH_MAX_SIZE", 500)
+	// GET and PUT /admin/config show and change the runtime-tunable
+	// settings. A PUT names only the fields it changes, e.g.
+	// {"temp_max":40,"log_sample_rate":0.1}; they take effect on the next
+	// request, and an invalid field rejects the whole update.
+	r.GET("/admin/config", apiKeyAuth, func(c *gin.Context) {
+		respondJSON(c, http.StatusOK, gin.H{"data": liveConfig().view()})
+	})
+	r.PUT("/admin/config", apiKeyAuth, requireJSON, func(c *gin.Context) {
+		var update map[string]json.RawMessage
+		if err := c.ShouldBindJSON(&update); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		cfg, err := updateRuntimeConfig(update)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		fields := make([]string, 0, len(update))
+		for field := range update {
+			fields = append(fields, field)
+		}
+		loggerFor(c).Info("runtime config updated", zap.Strings("fields", fields))
+		respondJSON(c, http.StatusOK, gin.H{"message": "config updated", "data": cfg.view()})
+	})
+
+	// POST /admin/replay-dlq retries the readings in DEAD_LETTER_FILE once
+	// whatever made them fail has been fixed. It is safe to run again,
+	// including after an interrupted run.
+	r.POST("/admin/replay-dlq", apiKeyAuth, requireReady, func(c *gin.Context) {
+		if deadLetters == nil {
+			respondJSON(c, http.StatusNotFound, gin.H{"error": "dead-lettering is disabled"})
+			return
+		}
+		result, err := deadLetters.replayFile(c.Request.Context(), sensorStore)
+		if err != nil {
+			loggerFor(c).Error("error replaying dead letters", zap.Int("replayed", result.Replayed), zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error(), "data": result})
+			return
+		}
+		loggerFor(c).Info("dead letters replayed", zap.Int("replayed", result.Replayed), zap.Int("succeeded", result.Succeeded),
+			zap.Int("failed", result.Failed), zap.Int("remaining", result.Remaining))
+		respondJSON(c, http.StatusOK, gin.H{"message": "dead letters replayed", "data": result})
+	})
+
+	r.POST("/sensor/batch", ipRateLimit, apiKeyAuth, requireReady, func(c *gin.Context) {
+		var payloads []SensorDataPayload
+		if err := json.NewDecoder(c.Request.Body).Decode(&payloads); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if len(payloads) == 0 {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": "no readings provided"})
+			return
+		}
+		if len(payloads) > maxBatchSize {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("batch size %d exceeds maximum of %d", len(payloads), maxBatchSize)})
+			return
+		}
+		// the whole batch is rejected if any reading is invalid
+		for i := range payloads {
+			err := binding.Validator.ValidateStruct(&payloads[i])
+			if err == nil {
+				err = validatePayload(payloads[i])
+			}
+			if err != nil {
+				respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error(), "index": i})
+				return
+			}
+			if !screenSensorFault(c, &payloads[i], gin.H{"index": i}) {
+				return
+			}
+		}
+		deviceIds := make([]string, len(payloads))
+		for i, payload := range payloads {
+			deviceIds[i] = payload.DeviceID
+		}
+		if !deviceRateLimit.allow(c, deviceIds...) {
+			return
+		}
+
+		insertedIds, err := sendSensorDataBatch(c.Request.Context(), sensorStore, payloads)
+		var batchErr *batchError
+		if errors.As(err, new(rangeError)) && errors.As(err, &batchErr) {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": batchErr.Err.Error(), "index": batchErr.Index})
+			return
+		}
+		if err != nil {
+			loggerFor(c).Error("error sending sensor data batch", zap.Error(err))
+			respondJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ids := make([]string, len(insertedIds))
+		for i, id := range insertedIds {
+			ids[i] = id.Hex()
+		}
+		loggerFor(c).Info("sensor data batch received", zap.Int("count", len(ids)))
+		status := http.StatusOK
+		if createdOnInsert {
+			status = http.StatusCreated
+		}
+		respondJSON(c, status, gin.H{"message": "sensor data batch received", "inserted_ids": ids})
+	})
+	r.GET("ws/sensor", requireReady, func(c *gin.Context) {
+		// ?deviceId= limits the snapshot and live updates to one device
+		deviceId, err := parseDeviceIdQuery(c)
+		if err != nil {
+			respondJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		wsCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ws, err := websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			loggerFor(c).Error("error upgrading to websocket", zap.Error(err))
+			return
+		}
+		defer ws.Close()
+		ws.SetReadLimit(wsReadLimit)
+		loggerFor(c).Info("websocket client connected", zap.String("remote_addr", ws.RemoteAddr().String()))
+		client := &wsClient{conn: ws, deviceID: deviceId}
+		lock.Lock()
+		clients = append(clients, client)
+		websocketClients.Set(float64(len(clients)))
+		lock.Unlock()
+
+		defer removeClients(client)
+		watchPongs(client)
+		go keepAlive(wsCtx, client)
+		// ?history=0 or ?live_only=true skips the initial dump for clients
+		// that load history over REST and only want live updates
+		liveOnly := c.Query("history") == "0" || c.Query("live_only") == "true"
+		if !liveOnly {
+			go broadcastAllSensorData(wsCtx, sensorStore, client)
+		}
+		for {
+			messageType, message, err := ws.ReadMessage()
+			if err != nil {
+				// a tab closing or a client disconnecting cleanly is routine
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					loggerFor(c).Error("error reading message", zap.Error(err))
+				} else {
+					loggerFor(c).Info("websocket client disconnected", zap.Error(err))
+				}
+				break
+			}
+			// any frame shows the client is alive, not just a pong
+			ws.SetReadDeadline(time.Now().Add(wsPongWait))
+			if messageType == websocket.PingMessage {
+				loggerFor(c).Info("pong...")
+				if err := client.writeMessage(websocket.PongMessage, nil); err != nil {
+					loggerFor(c).Error("error sending pong", zap.Error(err))
+					break
+				}
+			}
+			if messageType == websocket.TextMessage {
+				if err := client.writeJSON(handleCommand(client, message)); err != nil {
+					loggerFor(c).Error("error replying to websocket command", zap.Bool("permanent", isPermanentWSWriteError(err)), zap.Error(err))
+					if isPermanentWSWriteError(err) {
+						break
+					}
+				}
+			}
+		}
+	})
+
+	// GET /sensor/tail?device_id= follows a single device for field
+	// debugging: its last TAIL_HISTORY_SIZE readings, then each new one. A
+	// missing, invalid or unknown device id is reported in the close frame.
+	tailHistorySize := getEnvInt("TAIL_HISTORY_SIZE", 10)
+	if tailHistorySize <= 0 {
+		logger.Fatal("$TAIL_HISTORY_SIZE must be positive")
+	}
+	r.GET("/sensor/tail", requireReady, func(c *gin.Context) {
+		ws, err := websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			loggerFor(c).Error("error upgrading to websocket", zap.Error(err))
+			return
+		}
+		defer ws.Close()
+		ws.SetReadLimit(wsReadLimit)
+
+		deviceId, err := parseDeviceIdQuery(c)
+		if err == nil && deviceId == "" {
+			err = errors.New("device_id is required")
+		}
+		if err != nil {
+			closeWebsocket(ws, websocket.ClosePolicyViolation, err.Error())
+			return
+		}
+		countCtx, cancelCount := context.WithTimeout(c.Request.Context(), historyQueryTimeout)
+		count, err := sensorStore.Count(countCtx, SensorFilter{DeviceID: deviceId})
+		cancelCount()
+		if err != nil {
+			loggerFor(c).Error("error looking up device", zap.String("device_id", deviceId), zap.Error(err))
+			closeWebsocket(ws, websocket.CloseInternalServerErr, "error looking up device")
+			return
+		}
+		if count == 0 {
+			closeWebsocket(ws, websocket.ClosePolicyViolation, "unknown device "+deviceId)
+			return
+		}
+		loggerFor(c).Info("websocket tail connected", zap.String("device_id", deviceId), zap.String("remote_addr", ws.RemoteAddr().String()))
+
+		queryCtx, cancelQuery := context.WithTimeout(c.Request.Context(), historyQueryTimeout)
+		data, err := deviceTail(queryCtx, sensorStore, deviceId, tailHistorySize)
+		cancelQuery()
+		if err != nil {
+			loggerFor(c).Error("error retrieving device tail", zap.String("device_id", deviceId), zap.Error(err))
+			closeWebsocket(ws, websocket.CloseInternalServerErr, "error retrieving readings")
+			return
+		}
+		// the client is registered holding its write lock until the history
+		// has gone out, so live readings queue up behind it
+		client := &wsClient{conn: ws, deviceID: deviceId}
+		client.mu.Lock()
+		lock.Lock()
+		clients = append(clients, client)
+		websocketClients.Set(float64(len(clients)))
+		lock.Unlock()
+		ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		err = ws.WriteJSON(gin.H{"message": "recent sensor data", "device_id": deviceId, "data": data})
+		client.mu.Unlock()
+		defer removeClients(client)
+		if err != nil {
+			loggerFor(c).Error("error sending device tail", zap.String("device_id", deviceId), zap.Error(err))
+			return
+		}
+		wsCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		watchPongs(client)
+		go keepAlive(wsCtx, client)
+		// nothing the client sends is acted on; reading only notices the
+		// connection closing and keeps pongs flowing
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				loggerFor(c).Info("websocket tail disconnected", zap.String("device_id", deviceId), zap.Error(err))
+				return
+			}
+			ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+	})
+
+	r.GET("/data", func(c *gin.Context) {
+		c.Header("Content-Type", "text/html")
+		c.HTML(http.StatusOK, "data.html", gin.H{})
+	})
+	if getEnvBool("STATUS_PAGE_ENABLED", false) {
+		r.GET("/status", func(c *gin.Context) {
+			c.Data(http.StatusOK, "text/html; charset=utf-8", statusPage)
+		})
+	}
+
+	// HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT
+	// bound slow clients on ordinary routes; HTTP_IDLE_TIMEOUT bounds idle
+	// keep-alive connections. Websocket upgrades clear the connection
+	// deadlines and rely on their own ping/pong and write deadlines, and the
+	// CSV export lifts its write deadline since it streams for as long as
+	// the export takes.
+	srv := &http.Server{
+		Addr:              listenAddr(),
+		Handler:           r,
+		ReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+	}
+	// WS_HEARTBEAT_INTERVAL (default 30s, 0 to disable) paces the heartbeat
+	// broadcast, which stops when the server shuts down
+	if interval := getEnvDuration("WS_HEARTBEAT_INTERVAL", 30*time.Second); interval > 0 {
+		heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+		go heartbeat(heartbeatCtx, interval)
+		srv.RegisterOnShutdown(stopHeartbeat)
+	}
+	keepAlives := getEnvBool("HTTP_KEEPALIVES", true)
+	srv.SetKeepAlivesEnabled(keepAlives)
+
+	// TCP_KEEPALIVE_PERIOD tunes the listener's TCP keep-alive probes; a
+	// negative value disables them.
+	tcpKeepAlive := getEnvDuration("TCP_KEEPALIVE_PERIOD", 15*time.Second)
+	listenConfig := net.ListenConfig{KeepAlive: tcpKeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil {
+		logger.Fatal("Server start failed", zap.Error(err))
+	}
+	// serve HTTPS directly when both TLS_CERT_FILE and TLS_KEY_FILE are set
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		logger.Fatal("$TLS_CERT_FILE and $TLS_KEY_FILE must be set together")
+	}
+	useTLS := certFile != ""
+	logger.Info("http server listening",
+		zap.String("addr", srv.Addr),
+		zap.Bool("tls", useTLS),
+		zap.Duration("read_timeout", srv.ReadTimeout),
+		zap.Duration("write_timeout", srv.WriteTimeout),
+		zap.Duration("idle_timeout", srv.IdleTimeout),
+		zap.Bool("keepalives", keepAlives),
+		zap.Duration("tcp_keepalive", tcpKeepAlive))
+
+	go func() {
+		var err error
+		if useTLS {
+			err = srv.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Server start failed", zap.Error(err))
+		}
+	}()
+
+	connectTimeout := getEnvDuration("DB_CONNECT_TIMEOUT", 10*time.Second)
+	// DB_CONNECT_ATTEMPTS, DB_CONNECT_BACKOFF and DB_CONNECT_MAX_WAIT bound
+	// how long startup waits for MongoDB to come up
+	connectAttempts := getEnvInt("DB_CONNECT_ATTEMPTS", 5)
+	if connectAttempts <= 0 {
+		logger.Fatal("$DB_CONNECT_ATTEMPTS must be positive")
+	}
+	connectBackoff := getEnvDuration("DB_CONNECT_BACKOFF", time.Second)
+	connectMaxWait := getEnvDuration("DB_CONNECT_MAX_WAIT", 2*time.Minute)
+	dbClient, err = connectMongoWithRetry(mongoOpts, connectTimeout, connectAttempts, connectBackoff, connectMaxWait)
+	if err != nil {
+		logger.Fatal("error connecting to MongoDB", zap.Error(err))
+	}
+	logger.Info("mongodb connected")
 
+	// collection and index setup gets its own deadline, released as soon as
+	// startup is done rather than lingering for the life of the process
+	setupCtx, setupCancel := context.WithTimeout(context.Background(), connectTimeout)
+	sensorDB := dbClient.Database(dbName)
+	if cappedSize > 0 {
+		if err := ensureCappedCollection(setupCtx, sensorDB, collectionName, int64(cappedSize), int64(cappedMaxDocs)); err != nil {
+			logger.Fatal("error creating capped collection", zap.Error(err))
+		}
+	}
+	sensorCollection = sensorDB.Collection(collectionName)
+	if err := ensureIndexes(setupCtx, sensorCollection, retentionDays); err != nil {
+		logger.Fatal("error creating indexes", zap.Error(err))
+	}
+	sensorStore = newMongoSensorStore(sensorCollection)
+	setupCancel()
+	deviceCollection = sensorDB.Collection("devices")
+	// CALIBRATION_ENABLED corrects readings with their device's calibration
+	// from DEVICE_CALIBRATIONS or the devices collection before storing them
+	if getEnvBool("CALIBRATION_ENABLED", false) {
+		static, err := parseCalibrations(os.Getenv("DEVICE_CALIBRATIONS"))
+		if err != nil {
+			logger.Fatal("invalid $DEVICE_CALIBRATIONS", zap.Error(err))
+		}
+		cacheTTL := getEnvDuration("CALIBRATION_CACHE_TTL", time.Minute)
+		if cacheTTL <= 0 {
+			logger.Fatal("$CALIBRATION_CACHE_TTL must be positive")
+		}
+		calibrations = newCalibrationSource(deviceCollection, static, cacheTTL, getEnvBool("CALIBRATION_KEEP_RAW", false))
+	}
+	// DEAD_LETTER_ENABLED keeps readings that fail to insert in
+	// DEAD_LETTER_COLLECTION, or in DEAD_LETTER_FILE when that fails too
+	if getEnvBool("DEAD_LETTER_ENABLED", false) {
+		deadLetters = newDeadLetterSink(
+			sensorDB.Collection(getEnvNonEmpty("DEAD_LETTER_COLLECTION", "failed-readings")),
+			getEnvNonEmpty("DEAD_LETTER_FILE", "failed-readings.ndjson"),
+			getEnvDuration("DEAD_LETTER_TIMEOUT", 5*time.Second),
+		)
+	}
+
+	// a pool of workers drains SensorDataPayloads so one slow insert doesn't
+	// hold up every other client's POST
+	workerCount := getEnvInt("WORKER_COUNT", 4)
+	if workerCount <= 0 {
+		logger.Fatal("$WORKER_COUNT must be positive")
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for req := range SensorDataPayloads {
+				res := SensorDataResponse{}
+				data, err := sendSensorData(req.Ctx, sensorStore, req.Payload)
+				if err != nil {
+					loggerFromContext(req.Ctx).Error("error sending sensor data", zap.Error(err))
+					res.Err = err
+				} else {
+					insertedId := InsertedId(data.Id)
+					res.InsertedId = &insertedId
+					res.Data = data
+				}
+				req.ResponseChan <- res
+				if shuttingDown.Load() {
+					drainedCount.Add(1)
+				}
+			}
+		}()
+	}
+	logger.Info("insert workers started", zap.Int("count", workerCount))
+
+	ready.Store(true)
+	logger.Info("service ready", zap.Duration("startup_duration", time.Since(startedAt)))
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	<-quit
+	logger.Info("Shutting down server...")
+	shuttingDown.Store(true)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	// deferred so MongoDB is disconnected however the rest of shutdown goes,
+	// and only after the insert workers have drained
+	defer func() {
+		if err := dbClient.Disconnect(shutdownCtx); err != nil {
+			logger.Error("error disconnecting from MongoDB", zap.Error(err))
+			return
+		}
+		logger.Info("mongodb disconnected")
+	}()
+
+	// stop reusing connections so clients reconnect elsewhere while we drain
+	srv.SetKeepAlivesEnabled(false)
+	// Shutdown gives up on handlers still running when shutdownCtx expires,
+	// so exports are drained alongside it and truncated with a marker if
+	// they outlast EXPORT_DRAIN_TIMEOUT
+	exportsDrained := make(chan struct{})
+	go func() {
+		drainExports(exportDrainTimeout)
+		close(exportsDrained)
+	}()
 	if err := srv.Shutdown(shutdownCtx); err != nil {
-		logger.Fatal("Server forced to shutdown:", zap.Error(err))
+		logger.Error("Server forced to shutdown:", zap.Error(err))
 	}
+	<-exportsDrained
+	// Shutdown neither tracks hijacked websocket connections nor waits for
+	// its OnShutdown hooks, so the clients are closed here, synchronously,
+	// to be sure the going-away frames are written before the process exits
+	closeAllClients()
+
+	// the server has stopped handing out work; let the workers finish any
+	// request still in flight before exiting
+	closeSensorDataPayloads()
+	workers.Wait()
+	logger.Info("insert workers stopped", zap.Int64("drained", drainedCount.Load()))
 
 	logger.Info("Server exiting")
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestsTotal   *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+)
+
+var (
+	sensorInserts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sensor_inserts_total",
+		Help: "Readings successfully stored.",
+	})
+	sensorInsertFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sensor_insert_failures_total",
+		Help: "Readings that failed to store.",
+	})
+	sensorInsertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "sensor_insert_duration_seconds",
+		Help: "Time taken to store a reading (or a batch) in MongoDB.",
+	})
+	// websocketClients mirrors len(clients) and must only be set while
+	// holding lock.
+	websocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "websocket_clients",
+		Help: "Currently connected websocket clients.",
+	})
+	activeExports = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "active_exports",
+		Help: "Streaming exports currently being written.",
+	})
+)
+
+var insertStepdownRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "sensor_insert_stepdown_retries_total",
+	Help: "Inserts retried because the replica set had no writable primary.",
+})
+
+var ingestLag = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "sensor_ingest_lag_seconds",
+	Help:    "Delay between a reading's timestamp and it being stored.",
+	Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 30, 60, 300},
+})
+
+// registerHTTPMetrics creates the per-route RED collectors. Latency buckets
+// (in seconds) can be overridden with HTTP_LATENCY_BUCKETS.
+func registerHTTPMetrics() {
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and method.",
+		Buckets: getEnvFloatList("HTTP_LATENCY_BUCKETS", prometheus.DefBuckets),
+	}, []string{"route", "method"})
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration)
+}
+
+// metricsMiddleware labels requests with the gin route template rather than
+// the raw path so ids in the URL don't explode the label cardinality.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		// recorded in a defer so a panic unwinding past this middleware on
+		// its way to recoveryMiddleware is still counted, as the 500 it
+		// becomes; the panic is passed on unchanged
+		defer func() {
+			status := c.Writer.Status()
+			recovered := recover()
+			if recovered != nil {
+				status = http.StatusInternalServerError
+			}
+			route := c.FullPath()
+			if route == "" {
+				route = "unmatched"
+			}
+			method := c.Request.Method
+			httpRequestsTotal.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+			httpRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+			if recovered != nil {
+				panic(recovered)
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A panic must still be counted when recoveryMiddleware sits outside
+// metricsMiddleware, as it does in main.
+func TestMetricsMiddlewareCountsPanicsAs500(t *testing.T) {
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_http_requests_total"}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_http_request_duration_seconds"}, []string{"route", "method"})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(recoveryMiddleware(), metricsMiddleware())
+	r.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var m dto.Metric
+	if err := httpRequestsTotal.WithLabelValues("/panic", http.MethodGet, "500").Write(&m); err != nil {
+		t.Fatalf("reading counter: %v", err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Fatalf("http_requests_total{status=500} = %v, want 1", got)
+	}
+}
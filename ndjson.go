@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// readingsEmitter writes every stored reading as one NDJSON line for log
+// collectors tailing stdout (EMIT_STDOUT_NDJSON). zap logs to stderr, so the
+// two streams never interleave. It is nil, and emitting a no-op, when
+// disabled.
+var readingsEmitter *ndjsonEmitter
+
+type ndjsonEmitter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newNDJSONEmitter(w io.Writer) *ndjsonEmitter {
+	return &ndjsonEmitter{enc: json.NewEncoder(w)}
+}
+
+func (e *ndjsonEmitter) emit(data *SensorData) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(data); err != nil {
+		logger.Error("error emitting reading as ndjson", zap.Error(err))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// outboundClient is shared by every outbound call (webhooks, alerts) so an
+// error storm can't open an unbounded number of connections to the targets.
+var outboundClient *http.Client
+
+func newOutboundClient() *http.Client {
+	maxIdleConns := getEnvInt("OUTBOUND_MAX_IDLE_CONNS", 10)
+	maxConnsPerHost := getEnvInt("OUTBOUND_MAX_CONNS_PER_HOST", 10)
+	timeout := getEnvDuration("OUTBOUND_TIMEOUT", 10*time.Second)
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxConnsPerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: timeout,
+	}
+	logger.Info("outbound http client configured",
+		zap.Int("max_idle_conns", maxIdleConns),
+		zap.Int("max_conns_per_host", maxConnsPerHost),
+		zap.Duration("timeout", timeout))
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
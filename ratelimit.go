@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// keyedRateLimiter hands out one token bucket per key (a client IP or a
+// device id). Buckets that have been idle for longer than idleTTL are dropped
+// by cleanup so the map doesn't grow with every key that has ever posted.
+type keyedRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	limit    rate.Limit
+	burst    int
+	idleTTL  time.Duration
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedRateLimiter(limit rate.Limit, burst int, idleTTL time.Duration) *keyedRateLimiter {
+	return &keyedRateLimiter{
+		limiters: make(map[string]*limiterEntry),
+		limit:    limit,
+		burst:    burst,
+		idleTTL:  idleTTL,
+	}
+}
+
+func (l *keyedRateLimiter) get(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+func (l *keyedRateLimiter) cleanup() {
+	ticker := time.NewTicker(l.idleTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.mu.Lock()
+		for key, entry := range l.limiters {
+			if time.Since(entry.lastSeen) > l.idleTTL {
+				delete(l.limiters, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimitByIP limits requests per c.ClientIP() using RATE_LIMIT_RPS and
+// RATE_LIMIT_BURST. A non-positive RATE_LIMIT_RPS disables limiting.
+func rateLimitByIP() gin.HandlerFunc {
+	rps := getEnvFloat("RATE_LIMIT_RPS", 5)
+	burst := getEnvInt("RATE_LIMIT_BURST", 10)
+	idleTTL := getEnvDuration("RATE_LIMIT_IDLE_TTL", 10*time.Minute)
+	if rps <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	if burst <= 0 || idleTTL <= 0 {
+		logger.Fatal("$RATE_LIMIT_BURST and $RATE_LIMIT_IDLE_TTL must be positive")
+	}
+	limiter := newKeyedRateLimiter(rate.Limit(rps), burst, idleTTL)
+	go limiter.cleanup()
+
+	return func(c *gin.Context) {
+		reservation := limiter.get(c.ClientIP()).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			loggerFor(c).Warn("rate limit exceeded", zap.String("client_ip", c.ClientIP()), zap.String("path", c.Request.URL.Path))
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			abortWithJSON(c, http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// deviceRateLimiter limits ingest requests per device_id using
+// DEVICE_RATE_LIMIT_RPS and DEVICE_RATE_LIMIT_BURST, so one runaway device
+// behind a shared NAT doesn't use up its neighbours' per-IP budget. It is
+// nil, allowing everything, unless DEVICE_RATE_LIMIT_RPS is positive; set
+// RATE_LIMIT_RPS to 0 as well to limit by device instead of by IP.
+type deviceRateLimiter struct {
+	limiters *keyedRateLimiter
+}
+
+func newDeviceRateLimiter() *deviceRateLimiter {
+	rps := getEnvFloat("DEVICE_RATE_LIMIT_RPS", 0)
+	burst := getEnvInt("DEVICE_RATE_LIMIT_BURST", 5)
+	idleTTL := getEnvDuration("RATE_LIMIT_IDLE_TTL", 10*time.Minute)
+	if rps <= 0 {
+		return nil
+	}
+	if burst <= 0 || idleTTL <= 0 {
+		logger.Fatal("$DEVICE_RATE_LIMIT_BURST and $RATE_LIMIT_IDLE_TTL must be positive")
+	}
+	limiter := newKeyedRateLimiter(rate.Limit(rps), burst, idleTTL)
+	go limiter.cleanup()
+	return &deviceRateLimiter{limiters: limiter}
+}
+
+// allow takes one token from the bucket of each device the request carries
+// readings for, however many readings that is, so a batch of buffered
+// readings costs a device the same as a single post. If any device is over
+// its limit nothing is taken, a 429 naming that device is written and
+// allow returns false.
+func (l *deviceRateLimiter) allow(c *gin.Context, deviceIds ...string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	reservations := make(map[string]*rate.Reservation, len(deviceIds))
+	for _, deviceId := range deviceIds {
+		if _, ok := reservations[deviceId]; ok {
+			continue
+		}
+		reservation := l.limiters.get(deviceId).ReserveN(now, 1)
+		reservations[deviceId] = reservation
+		delay := reservation.DelayFrom(now)
+		if delay == 0 {
+			continue
+		}
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		loggerFor(c).Warn("device rate limit exceeded", zap.String("device_id", deviceId), zap.String("path", c.Request.URL.Path))
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		respondJSON(c, http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded for device " + deviceId, "device_id": deviceId})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+func newTestDeviceRateLimiter(burst int) func(deviceIds ...string) (bool, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	limiter := &deviceRateLimiter{limiters: newKeyedRateLimiter(rate.Every(time.Hour), burst, time.Minute)}
+	return func(deviceIds ...string) (bool, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/sensor", nil)
+		return limiter.allow(c, deviceIds...), w
+	}
+}
+
+func TestDeviceRateLimiterIsolatesDevices(t *testing.T) {
+	allow := newTestDeviceRateLimiter(2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := allow("noisy"); !ok {
+			t.Fatalf("request %d within the burst was limited", i+1)
+		}
+	}
+	ok, w := allow("noisy")
+	if ok || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("request over the burst: allowed = %v, status = %d, Retry-After = %q, want 429 with Retry-After", ok, w.Code, w.Header().Get("Retry-After"))
+	}
+	// a rejected batch must not spend the quiet device's tokens
+	if ok, _ := allow("quiet", "noisy"); ok {
+		t.Fatal("batch including a limited device was allowed")
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := allow("quiet"); !ok {
+			t.Fatalf("quiet device request %d was limited by its noisy neighbour", i+1)
+		}
+	}
+}
+
+func TestDeviceRateLimiterChargesBatchOncePerDevice(t *testing.T) {
+	allow := newTestDeviceRateLimiter(2)
+	batch := make([]string, 10)
+	for i := range batch {
+		batch[i] = "dev-1"
+	}
+
+	if ok, w := allow(batch...); !ok {
+		t.Fatalf("batch of %d readings from one device was limited with burst 2: %s", len(batch), w.Body.String())
+	}
+	if ok, _ := allow(batch...); !ok {
+		t.Fatal("second batch within the burst was limited")
+	}
+	if ok, _ := allow(batch...); ok {
+		t.Fatal("third batch over the burst was allowed")
+	}
+}
+
+func TestNilDeviceRateLimiterAllows(t *testing.T) {
+	var limiter *deviceRateLimiter
+	if !limiter.allow(nil, "dev-1", "dev-1") {
+		t.Fatal("disabled device limiter rejected a request")
+	}
+}
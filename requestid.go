@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// clientRequestIdPattern limits which client-supplied ids are trusted, so a
+// caller can't inject arbitrary text into our logs and headers.
+var clientRequestIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+type loggerCtxKey struct{}
+
+// requestID tags every request with an id, taken from X-Request-ID when the
+// client sends a usable one and generated otherwise. The id is echoed in the
+// response header, added to error bodies by respondJSON, and attached to a
+// request-scoped logger stored in the request context, so every line logged
+// through loggerFor or loggerFromContext can be correlated.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !clientRequestIdPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set("request_id", id)
+		c.Header(requestIDHeader, id)
+		ctx := context.WithValue(c.Request.Context(), loggerCtxKey{}, logger.With(zap.String("request_id", id)))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// loggerFromContext returns the request-scoped logger carried by ctx, or the
+// global logger for work that didn't come from a request.
+func loggerFromContext(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(loggerCtxKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+func loggerFor(c *gin.Context) *zap.Logger {
+	return loggerFromContext(c.Request.Context())
+}
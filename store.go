@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SensorFilter selects readings independently of the storage backend. Zero
+// fields don't constrain the result. MinQuality drops readings with a lower
+// quality; readings stored without one always match.
+type SensorFilter struct {
+	DeviceID   string
+	From       time.Time
+	To         time.Time
+	MinQuality float64
+}
+
+// SensorStore is the storage the reading handlers depend on, so they can
+// run against something other than a live MongoDB collection.
+type SensorStore interface {
+	// Add stores a reading and returns its new id.
+	Add(ctx context.Context, data *SensorData) (primitive.ObjectID, error)
+	// AddBatch stores readings in order, setting each one's Id.
+	AddBatch(ctx context.Context, data []*SensorData) ([]primitive.ObjectID, error)
+	// Get returns the reading with the given hex id, errInvalidSensorDataId
+	// for a malformed id, or mongo.ErrNoDocuments when there is none.
+	Get(ctx context.Context, id string) (*SensorData, error)
+	// Update replaces a reading's values with those of data, keeping its id
+	// and timestamp, and returns the updated reading; errors are as for Get.
+	Update(ctx context.Context, id string, data *SensorData) (*SensorData, error)
+	// Delete removes a reading and returns it, or mongo.ErrNoDocuments when
+	// there is no such reading.
+	Delete(ctx context.Context, id string) (*SensorData, error)
+	// GetAll returns one page of the readings matching filter, oldest first.
+	GetAll(ctx context.Context, filter SensorFilter, page, size int) ([]*SensorData, error)
+	// Query returns up to limit readings matching filter, oldest first.
+	Query(ctx context.Context, filter SensorFilter, limit int) ([]*SensorData, error)
+	// Count returns how many readings match filter.
+	Count(ctx context.Context, filter SensorFilter) (int64, error)
+	// DeviceHistory returns one page of a device's readings, newest first,
+	// and the device's total number of readings.
+	DeviceHistory(ctx context.Context, deviceId string, page, size int) ([]*SensorData, int64, error)
+	// Latest returns the most recent reading of every device, or only of
+	// deviceIds when any are given. Devices without readings are left out.
+	Latest(ctx context.Context, deviceIds ...string) ([]*SensorData, error)
+	// Sequences returns the seq of up to limit readings matching filter, in
+	// arrival order, skipping readings without one.
+	Sequences(ctx context.Context, filter SensorFilter, limit int) ([]int64, error)
+	// Downsample averages readings matching filter into buckets of the
+	// given size and passes them to emit oldest first, stopping at the
+	// first error emit returns or when ctx is done.
+	Downsample(ctx context.Context, filter SensorFilter, bucket time.Duration, emit func(SensorBucket) error) error
+	// Stats summarises the readings matching filter.
+	Stats(ctx context.Context, filter SensorFilter) (*SensorStats, error)
+	// Percentiles returns how many readings were sampled, at most
+	// maxSamples of those matching filter, and the percentiles ps of field
+	// over them.
+	Percentiles(ctx context.Context, field string, filter SensorFilter, ps []float64, maxSamples int) (int, []SensorPercentile, error)
+	// RateOfChange returns the per-second change of field between
+	// consecutive readings matching filter, over at most limit readings, or
+	// errNotEnoughSamples when fewer than two match.
+	RateOfChange(ctx context.Context, field string, filter SensorFilter, limit int) ([]SensorRate, error)
+	// ExportCSV writes the readings matching filter to w as CSV, oldest
+	// first, calling flush periodically, and returns how many rows it wrote.
+	ExportCSV(ctx context.Context, filter SensorFilter, w io.Writer, flush func()) (int, error)
+	// Backfill stores historical readings with their own timestamps and
+	// reports each one's outcome; one bad reading doesn't stop the rest.
+	Backfill(ctx context.Context, readings []BackfillReading) ([]BackfillResult, error)
+}
+
+// mongoSensorStore is the SensorStore backed by the readings collection.
+type mongoSensorStore struct {
+	mc *mongo.Collection
+}
+
+func newMongoSensorStore(mc *mongo.Collection) *mongoSensorStore {
+	return &mongoSensorStore{mc: mc}
+}
+
+func (f SensorFilter) bson() bson.M {
+	filter := readingsFilter(f.From, f.To, f.MinQuality)
+	if f.DeviceID != "" {
+		filter["device_id"] = f.DeviceID
+	}
+	return filter
+}
+
+func (s *mongoSensorStore) Add(ctx context.Context, data *SensorData) (primitive.ObjectID, error) {
+	return addSensorData(ctx, s.mc, data)
+}
+
+func (s *mongoSensorStore) AddBatch(ctx context.Context, data []*SensorData) ([]primitive.ObjectID, error) {
+	return addSensorDataBatch(ctx, s.mc, data)
+}
+
+func (s *mongoSensorStore) Get(ctx context.Context, id string) (*SensorData, error) {
+	return getSensorData(ctx, s.mc, id)
+}
+
+func (s *mongoSensorStore) Update(ctx context.Context, id string, data *SensorData) (*SensorData, error) {
+	return updateSensorData(ctx, s.mc, id, data)
+}
+
+func (s *mongoSensorStore) Delete(ctx context.Context, id string) (*SensorData, error) {
+	return deleteSensorData(ctx, s.mc, id)
+}
+
+func (s *mongoSensorStore) GetAll(ctx context.Context, filter SensorFilter, page, size int) ([]*SensorData, error) {
+	return getAllSensorData(ctx, s.mc, filter.bson(), page, size)
+}
+
+func (s *mongoSensorStore) Query(ctx context.Context, filter SensorFilter, limit int) ([]*SensorData, error) {
+	return querySensorData(ctx, s.mc, filter.bson(), limit)
+}
+
+func (s *mongoSensorStore) Count(ctx context.Context, filter SensorFilter) (int64, error) {
+	return s.mc.CountDocuments(ctx, filter.bson())
+}
+
+func (s *mongoSensorStore) DeviceHistory(ctx context.Context, deviceId string, page, size int) ([]*SensorData, int64, error) {
+	return getDeviceSensorData(ctx, s.mc, deviceId, page, size)
+}
+
+func (s *mongoSensorStore) Latest(ctx context.Context, deviceIds ...string) ([]*SensorData, error) {
+	return latestSensorDataPerDevice(ctx, s.mc, deviceIds...)
+}
+
+func (s *mongoSensorStore) Downsample(ctx context.Context, filter SensorFilter, bucket time.Duration, emit func(SensorBucket) error) error {
+	unit, binSize, err := bucketUnit(bucket)
+	if err != nil {
+		return err
+	}
+	return downsampleSensorData(ctx, s.mc, filter.bson(), unit, binSize, emit)
+}
+
+func (s *mongoSensorStore) Sequences(ctx context.Context, filter SensorFilter, limit int) ([]int64, error) {
+	return sensorSequences(ctx, s.mc, filter.bson(), limit)
+}
+
+func (s *mongoSensorStore) Stats(ctx context.Context, filter SensorFilter) (*SensorStats, error) {
+	return sensorStats(ctx, s.mc, filter.bson())
+}
+
+func (s *mongoSensorStore) Percentiles(ctx context.Context, field string, filter SensorFilter, ps []float64, maxSamples int) (int, []SensorPercentile, error) {
+	return sensorPercentiles(ctx, s.mc, field, filter.bson(), ps, maxSamples)
+}
+
+func (s *mongoSensorStore) RateOfChange(ctx context.Context, field string, filter SensorFilter, limit int) ([]SensorRate, error) {
+	return sensorRateOfChange(ctx, s.mc, field, filter.bson(), limit)
+}
+
+func (s *mongoSensorStore) ExportCSV(ctx context.Context, filter SensorFilter, w io.Writer, flush func()) (int, error) {
+	return exportSensorDataCSV(ctx, s.mc, filter.bson(), w, flush)
+}
+
+func (s *mongoSensorStore) Backfill(ctx context.Context, readings []BackfillReading) ([]BackfillResult, error) {
+	return addSensorDataBackfill(ctx, s.mc, readings)
+}
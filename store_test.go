@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func newMockMongo(t *testing.T) *mtest.T {
+	return mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+}
+
+func TestMongoSensorStoreAdd(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("success", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		store := newMongoSensorStore(mt.Coll)
+
+		data := &SensorData{DeviceID: "dev-1", Temperature: 21.5, Humidity: 40, Timestamp: time.Now().UTC()}
+		id, err := store.Add(context.Background(), data)
+		if err != nil {
+			mt.Fatalf("Add returned error: %v", err)
+		}
+		if id.IsZero() {
+			mt.Fatal("Add returned a zero id")
+		}
+	})
+}
+
+func TestMongoSensorStoreGet(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("found", func(mt *mtest.T) {
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.readings", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: id},
+			{Key: "device_id", Value: "dev-1"},
+			{Key: "temperature", Value: 21.5},
+			{Key: "humidity", Value: 40.0},
+		}))
+		store := newMongoSensorStore(mt.Coll)
+
+		data, err := store.Get(context.Background(), id.Hex())
+		if err != nil {
+			mt.Fatalf("Get returned error: %v", err)
+		}
+		if data.Id != id || data.DeviceID != "dev-1" {
+			mt.Fatalf("Get returned %+v, want id %s from dev-1", data, id.Hex())
+		}
+	})
+	mt.Run("not found", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.readings", mtest.FirstBatch))
+		store := newMongoSensorStore(mt.Coll)
+
+		_, err := store.Get(context.Background(), primitive.NewObjectID().Hex())
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			mt.Fatalf("Get returned %v, want mongo.ErrNoDocuments", err)
+		}
+	})
+	mt.Run("invalid id", func(mt *mtest.T) {
+		store := newMongoSensorStore(mt.Coll)
+
+		_, err := store.Get(context.Background(), "not-an-object-id")
+		if !errors.Is(err, errInvalidSensorDataId) {
+			mt.Fatalf("Get returned %v, want errInvalidSensorDataId", err)
+		}
+	})
+}
+
+// Delete hands back the removed reading so DELETE /sensor/:id can tell
+// which device's subscribers to notify.
+func TestMongoSensorStoreDelete(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("found", func(mt *mtest.T) {
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+			{Key: "_id", Value: id},
+			{Key: "device_id", Value: "dev-1"},
+		}}))
+		store := newMongoSensorStore(mt.Coll)
+
+		data, err := store.Delete(context.Background(), id.Hex())
+		if err != nil {
+			mt.Fatalf("Delete returned error: %v", err)
+		}
+		if data.Id != id || data.DeviceID != "dev-1" {
+			mt.Fatalf("Delete returned %+v, want id %s from dev-1", data, id.Hex())
+		}
+	})
+	mt.Run("not found", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		store := newMongoSensorStore(mt.Coll)
+
+		_, err := store.Delete(context.Background(), primitive.NewObjectID().Hex())
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			mt.Fatalf("Delete returned %v, want mongo.ErrNoDocuments", err)
+		}
+	})
+}
+
+// An empty result must encode as [] rather than null, which clients iterate
+// over without a nil check.
+func TestMongoSensorStoreEmptyResultsMarshalAsArray(t *testing.T) {
+	mt := newMockMongo(t)
+	emptyCursor := func() bson.D { return mtest.CreateCursorResponse(0, "db.readings", mtest.FirstBatch) }
+	cases := []struct {
+		name  string
+		query func(store SensorStore) (interface{}, error)
+		// how many commands the query sends, each answered with an empty cursor
+		commands int
+	}{
+		{"GetAll", func(store SensorStore) (interface{}, error) {
+			return store.GetAll(context.Background(), SensorFilter{}, 1, 100)
+		}, 1},
+		{"Latest", func(store SensorStore) (interface{}, error) {
+			return store.Latest(context.Background())
+		}, 1},
+		{"DeviceHistory", func(store SensorStore) (interface{}, error) {
+			data, _, err := store.DeviceHistory(context.Background(), "dev-1", 1, 100)
+			return data, err
+		}, 2},
+	}
+	for _, tc := range cases {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			for i := 0; i < tc.commands; i++ {
+				mt.AddMockResponses(emptyCursor())
+			}
+			data, err := tc.query(newMongoSensorStore(mt.Coll))
+			if err != nil {
+				mt.Fatalf("%s returned error: %v", tc.name, err)
+			}
+			body, err := json.Marshal(data)
+			if err != nil {
+				mt.Fatalf("marshal: %v", err)
+			}
+			if string(body) != "[]" {
+				mt.Fatalf("%s marshalled to %s, want []", tc.name, body)
+			}
+		})
+	}
+}
+
+func TestDeviceTailReturnsOldestFirst(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("tail", func(mt *mtest.T) {
+		// Mongo returns the newest readings first, after the device's count
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.readings", mtest.FirstBatch, bson.D{{Key: "n", Value: 3}}))
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.readings", mtest.FirstBatch,
+			bson.D{{Key: "device_id", Value: "dev-1"}, {Key: "temperature", Value: 23.0}},
+			bson.D{{Key: "device_id", Value: "dev-1"}, {Key: "temperature", Value: 22.0}},
+			bson.D{{Key: "device_id", Value: "dev-1"}, {Key: "temperature", Value: 21.0}},
+		))
+		data, err := deviceTail(context.Background(), newMongoSensorStore(mt.Coll), "dev-1", 3)
+		if err != nil {
+			mt.Fatalf("deviceTail returned error: %v", err)
+		}
+		if len(data) != 3 {
+			mt.Fatalf("got %d readings, want 3", len(data))
+		}
+		for i, want := range []float64{21, 22, 23} {
+			if data[i].Temperature != want {
+				mt.Fatalf("tail[%d].temperature = %v, want %v", i, data[i].Temperature, want)
+			}
+		}
+	})
+}
+
+func TestMongoSensorStoreLatestMatchesDeviceIds(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("latest for listed devices", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.readings", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "device_id", Value: "dev-1"},
+			{Key: "temperature", Value: 21.5},
+			{Key: "humidity", Value: 40.0},
+		}))
+		store := newMongoSensorStore(mt.Coll)
+
+		data, err := store.Latest(context.Background(), "dev-1", "dev-2")
+		if err != nil {
+			mt.Fatalf("Latest returned error: %v", err)
+		}
+		if len(data) != 1 || data[0].DeviceID != "dev-1" {
+			mt.Fatalf("Latest returned %+v, want one reading from dev-1", data)
+		}
+		pipeline := mt.GetStartedEvent().Command.Lookup("pipeline").Array()
+		match, ok := pipeline.Index(0).Value().Document().Lookup("$match").DocumentOK()
+		if !ok {
+			mt.Fatalf("first pipeline stage is %s, want $match", pipeline.Index(0))
+		}
+		var ids []string
+		if err := match.Lookup("device_id", "$in").Unmarshal(&ids); err != nil {
+			mt.Fatalf("decoding $match device_id $in: %v", err)
+		}
+		if !reflect.DeepEqual(ids, []string{"dev-1", "dev-2"}) {
+			mt.Fatalf("$match device_id $in %v, want [dev-1 dev-2]", ids)
+		}
+	})
+}
+
+// Cancelling the request mid-stream must stop emitting buckets and kill the
+// server-side cursor, even though later buckets are already buffered.
+func TestMongoSensorStoreDownsampleStopsOnCancel(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("cancel", func(mt *mtest.T) {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(42, "db.readings", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: start}, {Key: "count", Value: 1}},
+				bson.D{{Key: "_id", Value: start.Add(5 * time.Minute)}, {Key: "count", Value: 1}},
+				bson.D{{Key: "_id", Value: start.Add(10 * time.Minute)}, {Key: "count", Value: 1}},
+			),
+			mtest.CreateSuccessResponse(),
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		emitted := 0
+		err := newMongoSensorStore(mt.Coll).Downsample(ctx, SensorFilter{}, 5*time.Minute, func(SensorBucket) error {
+			emitted++
+			cancel()
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			mt.Fatalf("Downsample returned %v, want context.Canceled", err)
+		}
+		if emitted != 1 {
+			mt.Fatalf("emitted %d buckets after cancelling, want 1", emitted)
+		}
+		mt.GetStartedEvent() // aggregate
+		if evt := mt.GetStartedEvent(); evt == nil || evt.CommandName != "killCursors" {
+			mt.Fatalf("next command = %v, want killCursors", evt)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamFlushEvery is how many array elements a jsonArrayStream writes
+// between flushes.
+const streamFlushEvery = 100
+
+// jsonArrayStream writes a JSON object with one array field produced an
+// element at a time, {"bucket":"5m0s","data":[...]}, so large results go
+// out as they are read instead of being held in memory. Nothing is written
+// until the first element or finish, so a failure before any data can
+// still be answered with an ordinary error response.
+type jsonArrayStream struct {
+	c *gin.Context
+	// head holds the fields written before the array, field names it
+	head  gin.H
+	field string
+	// started reports whether the status line and head have been sent, n
+	// how many elements have been written
+	started bool
+	n       int
+}
+
+func (s *jsonArrayStream) begin() error {
+	s.started = true
+	head, err := json.Marshal(s.head)
+	if err != nil {
+		return err
+	}
+	field, err := json.Marshal(s.field)
+	if err != nil {
+		return err
+	}
+	s.c.Header("Content-Type", "application/json; charset=utf-8")
+	s.c.Status(http.StatusOK)
+	// reopen the head object to append the array to it
+	out := head[:len(head)-1]
+	if len(s.head) > 0 {
+		out = append(out, ',')
+	}
+	out = append(out, field...)
+	out = append(out, ':', '[')
+	_, err = s.c.Writer.Write(out)
+	return err
+}
+
+// write appends v to the array.
+func (s *jsonArrayStream) write(v interface{}) error {
+	if !s.started {
+		if err := s.begin(); err != nil {
+			return err
+		}
+	}
+	element, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.n > 0 {
+		element = append([]byte{','}, element...)
+	}
+	if _, err := s.c.Writer.Write(element); err != nil {
+		return err
+	}
+	s.n++
+	if s.n%streamFlushEvery == 0 {
+		s.c.Writer.Flush()
+	}
+	return nil
+}
+
+// finish closes the array and then the object, adding tail's fields after
+// the array, e.g. truncated and error when the stream broke off part way.
+func (s *jsonArrayStream) finish(tail gin.H) error {
+	if !s.started {
+		if err := s.begin(); err != nil {
+			return err
+		}
+	}
+	out := []byte{']'}
+	if len(tail) > 0 {
+		fields, err := json.Marshal(tail)
+		if err != nil {
+			return err
+		}
+		out = append(out, ',')
+		out = append(out, fields[1:]...)
+	} else {
+		out = append(out, '}')
+	}
+	if _, err := s.c.Writer.Write(out); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
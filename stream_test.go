@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestJSONArrayStreamWritesValidJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		name     string
+		elements []int
+		tail     gin.H
+		want     string
+	}{
+		{"empty", nil, nil, `{"bucket":"5m0s","data":[]}`},
+		{"elements", []int{1, 2}, nil, `{"bucket":"5m0s","data":[1,2]}`},
+		{"truncated", []int{1}, gin.H{"truncated": true}, `{"bucket":"5m0s","data":[1],"truncated":true}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			stream := &jsonArrayStream{c: c, head: gin.H{"bucket": "5m0s"}, field: "data"}
+			for _, e := range tc.elements {
+				if err := stream.write(e); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			if err := stream.finish(tc.tail); err != nil {
+				t.Fatalf("finish: %v", err)
+			}
+			if got := w.Body.String(); got != tc.want || !json.Valid(w.Body.Bytes()) {
+				t.Fatalf("body = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
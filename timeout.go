@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// requestTimeout puts a deadline of REQUEST_TIMEOUT (default 30s, 0 to
+// disable) on every request context, so database calls made with
+// c.Request.Context() give up instead of holding the request open. Websocket
+// connections and the CSV export are long-lived by design and are left
+// without a deadline.
+func requestTimeout() gin.HandlerFunc {
+	timeout := getEnvDuration("REQUEST_TIMEOUT", 30*time.Second)
+	logger.Info("request timeout configured", zap.Duration("timeout", timeout))
+	return func(c *gin.Context) {
+		if timeout <= 0 || websocket.IsWebSocketUpgrade(c.Request) || c.FullPath() == "/sensor/export.csv" {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
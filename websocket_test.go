@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// newTestWSClient opens a real websocket connection through an httptest
+// server and returns the server side wrapped as a wsClient, plus the
+// client side for reading what the server sends.
+func newTestWSClient(t *testing.T) (*wsClient, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	conn := <-serverConns
+	t.Cleanup(func() { conn.Close() })
+	return &wsClient{conn: conn}, peer
+}
+
+// registerTestClients replaces the global client list for one test.
+func registerTestClients(t *testing.T, toAdd ...*wsClient) {
+	t.Helper()
+	lock.Lock()
+	clients = append([]*wsClient(nil), toAdd...)
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		clients = nil
+		lock.Unlock()
+	})
+}
+
+func connectedClients() []*wsClient {
+	lock.Lock()
+	defer lock.Unlock()
+	return append([]*wsClient(nil), clients...)
+}
+
+func TestBroadcastMessagePrunesFailedClients(t *testing.T) {
+	healthy, healthyPeer := newTestWSClient(t)
+	dead, _ := newTestWSClient(t)
+	// closing the server side makes every later write to it fail
+	dead.conn.Close()
+	registerTestClients(t, healthy, dead)
+
+	broadcastMessage(gin.H{"message": "hello"}, nil)
+
+	remaining := connectedClients()
+	if len(remaining) != 1 || remaining[0] != healthy {
+		t.Fatalf("after broadcast clients = %v, want only the healthy client", remaining)
+	}
+	healthyPeer.SetReadDeadline(time.Now().Add(time.Second))
+	var got map[string]interface{}
+	if err := healthyPeer.ReadJSON(&got); err != nil {
+		t.Fatalf("healthy client did not receive the broadcast: %v", err)
+	}
+	if got["message"] != "hello" {
+		t.Fatalf("healthy client received %v", got)
+	}
+}
+
+// fakeSensorStore serves GetAll from memory; other methods are unused here
+// and panic through the nil embedded interface.
+type fakeSensorStore struct {
+	SensorStore
+	data []*SensorData
+}
+
+func (s *fakeSensorStore) GetAll(ctx context.Context, filter SensorFilter, page, size int) ([]*SensorData, error) {
+	return s.data, nil
+}
+
+func TestBroadcastAllSensorDataDropsClientOnWriteFailure(t *testing.T) {
+	client, _ := newTestWSClient(t)
+	client.conn.Close()
+	registerTestClients(t, client)
+	store := &fakeSensorStore{data: []*SensorData{{DeviceID: "dev-1", Temperature: 21, Humidity: 40}}}
+
+	if err := broadcastAllSensorData(context.Background(), store, client); err == nil {
+		t.Fatal("broadcastAllSensorData succeeded writing to a closed connection")
+	}
+	if remaining := connectedClients(); len(remaining) != 0 {
+		t.Fatalf("client whose snapshot write failed was kept: %v", remaining)
+	}
+}
+
+func TestHandleCommandValidatesEnvelope(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		wantError string
+		wantDev   string
+	}{
+		{"subscribe", `{"v":1,"cmd":"subscribe","args":{"device_id":"dev-1"}}`, "", "dev-1"},
+		{"unsubscribe without args", `{"v":1,"cmd":"unsubscribe"}`, "", ""},
+		{"not json", `subscribe dev-1`, "invalid_message", "dev-0"},
+		{"unknown envelope field", `{"v":1,"cmd":"unsubscribe","action":"x"}`, "invalid_message", "dev-0"},
+		{"missing version", `{"cmd":"unsubscribe"}`, "unsupported_version", "dev-0"},
+		{"future version", `{"v":2,"cmd":"unsubscribe"}`, "unsupported_version", "dev-0"},
+		{"unknown command", `{"v":1,"cmd":"replay"}`, "unknown_command", "dev-0"},
+		{"unknown arg", `{"v":1,"cmd":"subscribe","args":{"deviceId":"dev-1"}}`, "invalid_args", "dev-0"},
+		{"invalid device id", `{"v":1,"cmd":"subscribe","args":{"device_id":"../x"}}`, "invalid_args", "dev-0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &wsClient{deviceID: "dev-0"}
+			reply := handleCommand(client, []byte(tt.message))
+			if reply["v"] != wsProtocolVersion {
+				t.Errorf("reply v = %v, want %d", reply["v"], wsProtocolVersion)
+			}
+			wsErr, _ := reply["error"].(*wsError)
+			switch {
+			case tt.wantError == "" && wsErr != nil:
+				t.Fatalf("unexpected error %+v", wsErr)
+			case tt.wantError != "" && (wsErr == nil || wsErr.Code != tt.wantError):
+				t.Fatalf("reply = %v, want error code %q", reply, tt.wantError)
+			}
+			if got := client.device(); got != tt.wantDev {
+				t.Fatalf("device filter = %q, want %q", got, tt.wantDev)
+			}
+		})
+	}
+}
+
+// The going-away close frame must carry a reconnect hint within
+// [wsReconnectBase, 2*wsReconnectBase).
+func TestCloseAllClientsSendsReconnectHint(t *testing.T) {
+	client, peer := newTestWSClient(t)
+	registerTestClients(t, client)
+
+	closeAllClients()
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := peer.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("read error = %v, want a going-away close", err)
+	}
+	var reason struct {
+		ReconnectAfterMs int64 `json:"reconnect_after_ms"`
+	}
+	if err := json.Unmarshal([]byte(closeErr.Text), &reason); err != nil {
+		t.Fatalf("close reason %q is not JSON: %v", closeErr.Text, err)
+	}
+	base := wsReconnectBase.Milliseconds()
+	if reason.ReconnectAfterMs < base || reason.ReconnectAfterMs >= 2*base {
+		t.Fatalf("reconnect_after_ms = %d, want within [%d, %d)", reason.ReconnectAfterMs, base, 2*base)
+	}
+}
+
+// Concurrent broadcasts to one client must arrive as whole, separate
+// messages rather than interleaved frames.
+func TestConcurrentBroadcastsToOneClient(t *testing.T) {
+	client, peer := newTestWSClient(t)
+	registerTestClients(t, client)
+	const n = 50
+	// big enough to span several frames with the default write buffer
+	filler := strings.Repeat("x", 8192)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			broadcastMessage(gin.H{"seq": i, "filler": filler}, nil)
+		}(i)
+	}
+
+	seen := make(map[int]bool)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(seen) < n {
+		var got struct {
+			Seq    int    `json:"seq"`
+			Filler string `json:"filler"`
+		}
+		if err := peer.ReadJSON(&got); err != nil {
+			t.Fatalf("after %d messages: %v", len(seen), err)
+		}
+		if got.Filler != filler || seen[got.Seq] {
+			t.Fatalf("message %d arrived corrupted or twice", got.Seq)
+		}
+		seen[got.Seq] = true
+	}
+	wg.Wait()
+	if remaining := connectedClients(); len(remaining) != 1 {
+		t.Fatalf("client was dropped during concurrent broadcasts")
+	}
+}
+
+// A message that can't be encoded is a temporary failure: nothing reaches
+// the client and the connection stays usable.
+func TestWriteJSONEncodeErrorIsTemporary(t *testing.T) {
+	client, peer := newTestWSClient(t)
+
+	err := client.writeJSON(gin.H{"bad": math.NaN()})
+	if err == nil || isPermanentWSWriteError(err) {
+		t.Fatalf("writeJSON(NaN) = %v, want a temporary error", err)
+	}
+	if err := client.writeJSON(gin.H{"message": "ok"}); err != nil {
+		t.Fatalf("write after encode error: %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var got map[string]interface{}
+	if err := peer.ReadJSON(&got); err != nil || got["message"] != "ok" {
+		t.Fatalf("first message received = %v, %v; want the ok message", got, err)
+	}
+}